@@ -7,36 +7,52 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type HookInfo struct {
 	Server  string
 	Email   string
 	Domains []string
+	// ReloadError is the error of reloading nginx with the new certificate,
+	// or empty if it succeeded.
+	ReloadError string
 }
 
 func CallHooks(info *HookInfo) error {
+	return RunHooks(info, nil)
+}
+
+// RunHooks is like CallHooks, and if ran is not nil, it's called with the
+// name, duration and result of each hook that runs.
+func RunHooks(info *HookInfo, ran func(name string, d time.Duration, err error)) error {
 	entries, err := os.ReadDir(HooksDir)
 	if err != nil {
 		return err
 	}
 	for _, entry := range entries {
-		err := runHookEntry(entry, info)
+		start := time.Now()
+		run, err := runHookEntry(entry, info)
 		if err != nil {
 			slog.Error("failed to run hook", "name", entry.Name(), "error", err)
 		}
+		if run && ran != nil {
+			ran(entry.Name(), time.Since(start), err)
+		}
 	}
 	return nil
 }
 
-func runHookEntry(entry fs.DirEntry, info *HookInfo) error {
+// runHookEntry runs the hook if it's an executable file, and reports whether
+// it does.
+func runHookEntry(entry fs.DirEntry, info *HookInfo) (bool, error) {
 	fsinfo, err := entry.Info()
 	if err != nil {
-		return err
+		return false, err
 	}
 	mode := fsinfo.Mode()
 	if mode&fs.ModeType != 0 || mode&0111 == 0 {
-		return nil
+		return false, nil
 	}
 	name := filepath.Join(HooksDir, entry.Name())
 	cmd := exec.Command(name)
@@ -46,6 +62,7 @@ func runHookEntry(entry fs.DirEntry, info *HookInfo) error {
 		"ACME_SERVER=" + info.Server,
 		"ACME_EMAIL=" + info.Email,
 		"ACME_DOMAIN=" + strings.Join(info.Domains, " "),
+		"ACME_RELOAD_ERROR=" + info.ReloadError,
 	}
-	return cmd.Run()
+	return true, cmd.Run()
 }
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/hgl/acmehugger/internal/util"
 )
@@ -17,6 +19,7 @@ func TestHook(t *testing.T) {
 	echo "$ACME_SERVER"
 	echo "$ACME_EMAIL"
 	echo "$ACME_DOMAIN"
+	echo "$ACME_RELOAD_ERROR"
 } > "%s/env"
 `, HooksDir)
 	err := os.WriteFile(name, []byte(content), 0755)
@@ -24,9 +27,10 @@ func TestHook(t *testing.T) {
 		t.Fatal(err)
 	}
 	err = CallHooks(&HookInfo{
-		Server:  "example",
-		Email:   "foo@bar",
-		Domains: []string{"a", "b"},
+		Server:      "example",
+		Email:       "foo@bar",
+		Domains:     []string{"a", "b"},
+		ReloadError: "failed",
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -38,8 +42,24 @@ func TestHook(t *testing.T) {
 	want := `example
 foo@bar
 a b
+failed
 `
 	if got != want {
 		t.Fatalf("got\n%s\nwant\n%s", got, want)
 	}
+
+	// the env file written by the hook is not executable
+	var ran []string
+	err = RunHooks(&HookInfo{}, func(name string, d time.Duration, err error) {
+		if err != nil {
+			t.Errorf("hook %s failed: %v", name, err)
+		}
+		ran = append(ran, name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.sh"}; !slices.Equal(ran, want) {
+		t.Errorf("hooks run = %q, want %q", ran, want)
+	}
 }
@@ -8,6 +8,7 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -140,6 +141,16 @@ type IssueOptions struct {
 	Days      *int
 	Challenge ChallengeType
 	DNS       DNS
+	Outputs   []*Output
+}
+
+// RenewBefore returns how long before expiring a certificate is renewed.
+func (opts *IssueOptions) RenewBefore() time.Duration {
+	days := DefaultDays
+	if opts.Days != nil {
+		days = *opts.Days
+	}
+	return time.Duration(days) * 24 * time.Hour
 }
 
 func (opts *IssueOptions) Clone() *IssueOptions {
@@ -155,6 +166,7 @@ func (opts *IssueOptions) Clone() *IssueOptions {
 		}
 		opts.DNS.Options = m
 	}
+	nopts.Outputs = slices.Clone(opts.Outputs)
 	return &nopts
 }
 
@@ -176,6 +188,17 @@ func ParseChallengeType(s string) (ChallengeType, error) {
 	}
 }
 
+func (t ChallengeType) String() string {
+	switch t {
+	case ChallengeHTTP:
+		return "http"
+	case ChallengeDNS:
+		return "dns"
+	default:
+		panic("unknown ChallengeType")
+	}
+}
+
 type DNS struct {
 	Name    string
 	Options map[string]string
@@ -192,14 +215,28 @@ type IssueInfo struct {
 	RenewTimer clock.Timer
 	Changed    bool
 	CertPaths  *CertPaths
+	// NotAfter is when the certificate expires, and RenewAt is when it's
+	// renewed.
+	NotAfter time.Time
+	RenewAt  time.Time
+	// DeployErr is the error of deploying the outputs, which doesn't fail
+	// the issuance. Deploy retries it.
+	DeployErr error
 }
 
+// Issue issues a certificate for the domains, unless one has been issued
+// and hasn't reached its renew time.
 func (issuer *Issuer) Issue(domains []string, opts *IssueOptions) (*IssueInfo, error) {
-	days := DefaultDays
-	if opts.Days != nil {
-		days = *opts.Days
-	}
-	daysDur := time.Duration(days) * 24 * time.Hour
+	return issuer.issue(domains, opts, false)
+}
+
+// Renew is like Issue, but always issues a new certificate.
+func (issuer *Issuer) Renew(domains []string, opts *IssueOptions) (*IssueInfo, error) {
+	return issuer.issue(domains, opts, true)
+}
+
+func (issuer *Issuer) issue(domains []string, opts *IssueOptions, force bool) (*IssueInfo, error) {
+	daysDur := opts.RenewBefore()
 
 	mainDomain := domains[0]
 	paths, err := newCertPaths(issuer.certDir, mainDomain)
@@ -215,10 +252,13 @@ func (issuer *Issuer) Issue(domains []string, opts *IssueOptions) (*IssueInfo, e
 		return nil, err
 	} else if set.EqualSet(x509crt.DNSNames, domains) {
 		left := clock.Until(x509crt.NotAfter.Add(-daysDur))
-		if left > 0 {
+		if left > 0 && !force {
+			info.NotAfter = x509crt.NotAfter
+			info.RenewAt = x509crt.NotAfter.Add(-daysDur)
 			info.RenewTimer = clock.NewTimer(left)
 			slog.Info("has't reached renew time, renewal skipped", "time left", left,
 				"domains", domains)
+			info.DeployErr = deployOutputs(opts.Outputs, paths, mainDomain)
 			return info, nil
 		}
 		slog.Info("renewing", "domain", mainDomain)
@@ -244,8 +284,9 @@ func (issuer *Issuer) Issue(domains []string, opts *IssueOptions) (*IssueInfo, e
 	if err != nil {
 		return nil, err
 	}
-	dur := clock.Until(x509crt.NotAfter.Add(-daysDur))
-	info.RenewTimer = clock.NewTimer(dur)
+	info.NotAfter = x509crt.NotAfter
+	info.RenewAt = x509crt.NotAfter.Add(-daysDur)
+	info.RenewTimer = clock.NewTimer(clock.Until(info.RenewAt))
 
 	err = os.WriteFile(paths.Key, crt.Key, 0600)
 	if err != nil {
@@ -274,7 +315,20 @@ func (issuer *Issuer) Issue(domains []string, opts *IssueOptions) (*IssueInfo, e
 	err = util.WriteJSON(paths.Info, map[string]any{
 		"certUrl": crt.URL,
 	}, 0644)
-	return info, err
+	if err != nil {
+		return nil, err
+	}
+	info.DeployErr = deployOutputs(opts.Outputs, paths, mainDomain)
+	return info, nil
+}
+
+// Deploy deploys the outputs of the issued certificate for the domains.
+func (issuer *Issuer) Deploy(domains []string, opts *IssueOptions) error {
+	paths, err := newCertPaths(issuer.certDir, domains[0])
+	if err != nil {
+		return err
+	}
+	return deployOutputs(opts.Outputs, paths, domains[0])
 }
 
 func (issuer *Issuer) HandlerAccount() *HandlerAccount {
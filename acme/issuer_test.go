@@ -126,6 +126,12 @@ func TestIssuer(t *testing.T) {
 	if *info.CertPaths != *paths {
 		t.Errorf("cert paths = %#v, want %#v", info.CertPaths, paths)
 	}
+	if notAfter := crt.NotAfter.Truncate(time.Second); !info.NotAfter.Equal(notAfter) {
+		t.Errorf("not after = %v, want %v", info.NotAfter, notAfter)
+	}
+	if renewAt := info.NotAfter.Add(-DefaultDays * 24 * time.Hour); !info.RenewAt.Equal(renewAt) {
+		t.Errorf("renew at = %v, want %v", info.RenewAt, renewAt)
+	}
 
 	data, err = os.ReadFile(paths.Key)
 	if err != nil {
@@ -180,6 +186,54 @@ func TestIssuer(t *testing.T) {
 	if *info.CertPaths != *paths {
 		t.Errorf("cert paths = %#v, want %#v", info.CertPaths, paths)
 	}
+	if notAfter := crt.NotAfter.Truncate(time.Second); !info.NotAfter.Equal(notAfter) {
+		t.Errorf("not after = %v, want %v", info.NotAfter, notAfter)
+	}
+	if renewAt := info.NotAfter.Add(-DefaultDays * 24 * time.Hour); !info.RenewAt.Equal(renewAt) {
+		t.Errorf("renew at = %v, want %v", info.RenewAt, renewAt)
+	}
+
+	handler.ExpectedIssueCalls.Store(1)
+	info, err = issuer.Renew(domains, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.checkCalls()
+	if !info.Changed {
+		t.Fatalf("cert should be renewed when forced")
+	}
+
+	// a file is in the way of the output
+	outDir := t.TempDir()
+	err = os.WriteFile(filepath.Join(outDir, "sub"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Outputs = []*Output{{Type: OutputFullChain, Path: outDir + "/sub/a.crt"}}
+	handler.ExpectedIssueCalls.Store(1)
+	info, err = issuer.Renew(domains, opts)
+	if err != nil {
+		t.Fatalf("failing to deploy outputs should not fail renewing: %v", err)
+	}
+	handler.checkCalls()
+	if !info.Changed || info.DeployErr == nil {
+		t.Fatalf("cert should be renewed with a deploy error")
+	}
+	err = os.Remove(filepath.Join(outDir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = issuer.Deploy(domains, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(outDir + "/sub/a.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(data, crtData) {
+		t.Errorf("deployed full chain = %#v, want %#v", data, crtData)
+	}
 }
 
 type handlerMock struct {
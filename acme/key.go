@@ -43,6 +43,25 @@ func ParseKeyType(s string) (KeyType, error) {
 	}
 }
 
+func (t KeyType) String() string {
+	switch t {
+	case KeyEC256:
+		return "ec256"
+	case KeyEC384:
+		return "ec384"
+	case KeyRSA2048:
+		return "rsa2048"
+	case KeyRSA3072:
+		return "rsa3072"
+	case KeyRSA4096:
+		return "rsa4096"
+	case KeyRSA8192:
+		return "rsa8192"
+	default:
+		panic("unknown KeyType")
+	}
+}
+
 func (t KeyType) Size() int {
 	switch t {
 	case KeyEC256:
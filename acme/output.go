@@ -0,0 +1,276 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hgl/acmehugger/internal/util"
+	"golang.org/x/net/idna"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+type OutputType int
+
+const (
+	OutputPEM OutputType = iota
+	OutputPKCS12
+	OutputKey
+	OutputFullChain
+	OutputChain
+)
+
+func ParseOutputCopyType(s string) (OutputType, error) {
+	switch s {
+	case "key":
+		return OutputKey, nil
+	case "fullchain":
+		return OutputFullChain, nil
+	case "chain":
+		return OutputChain, nil
+	default:
+		return -1, fmt.Errorf("invalid output copy type: %s", s)
+	}
+}
+
+func (t OutputType) String() string {
+	switch t {
+	case OutputPEM:
+		return "pem"
+	case OutputPKCS12:
+		return "pkcs12"
+	case OutputKey:
+		return "key"
+	case OutputFullChain:
+		return "fullchain"
+	case OutputChain:
+		return "chain"
+	default:
+		panic("unknown OutputType")
+	}
+}
+
+// Output describes a file derived from an issued certificate, written in
+// addition to the files under CertsDir. Path may contain $domain, which is
+// replaced with the certificate's main domain.
+type Output struct {
+	Type     OutputType
+	Path     string
+	Password string
+	Owner    string
+	Group    string
+	Mode     fs.FileMode
+}
+
+func (o *Output) ParseParams(params []string) error {
+	for _, param := range params {
+		k, v, ok := strings.Cut(param, "=")
+		if !ok {
+			return fmt.Errorf("invalid output parameter: %s", param)
+		}
+		switch k {
+		case "owner":
+			o.Owner = v
+		case "group":
+			o.Group = v
+		case "mode":
+			mode, err := strconv.ParseUint(v, 8, 32)
+			if err != nil || mode&^uint64(fs.ModePerm) != 0 {
+				return fmt.Errorf("invalid output mode: %s", v)
+			}
+			o.Mode = fs.FileMode(mode)
+		case "password":
+			if o.Type != OutputPKCS12 {
+				return fmt.Errorf("password is only valid for pkcs12 outputs")
+			}
+			o.Password = v
+		default:
+			return fmt.Errorf("unknown output parameter: %s", k)
+		}
+	}
+	return nil
+}
+
+func (o *Output) ResolvePath(domain string) (string, error) {
+	if !strings.Contains(o.Path, "$domain") {
+		return o.Path, nil
+	}
+	name, err := idna.ToASCII(strings.NewReplacer("*", "_").Replace(domain))
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(o.Path, "$domain", name), nil
+}
+
+func (o *Output) perm() fs.FileMode {
+	if o.Mode != 0 {
+		return o.Mode
+	}
+	switch o.Type {
+	case OutputFullChain, OutputChain:
+		return 0644
+	default:
+		return 0600
+	}
+}
+
+func (o *Output) ids() (uid int, gid int, err error) {
+	uid, gid = -1, -1
+	if o.Owner != "" {
+		uid, err = strconv.Atoi(o.Owner)
+		if err != nil {
+			u, err := user.Lookup(o.Owner)
+			if err != nil {
+				return -1, -1, err
+			}
+			uid, err = strconv.Atoi(u.Uid)
+			if err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+	if o.Group != "" {
+		gid, err = strconv.Atoi(o.Group)
+		if err != nil {
+			g, err := user.LookupGroup(o.Group)
+			if err != nil {
+				return -1, -1, err
+			}
+			gid, err = strconv.Atoi(g.Gid)
+			if err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+func (o *Output) content(paths *CertPaths) ([]byte, error) {
+	switch o.Type {
+	case OutputKey:
+		return os.ReadFile(paths.Key)
+	case OutputFullChain:
+		return os.ReadFile(paths.FullChain)
+	case OutputChain:
+		return os.ReadFile(paths.Chain)
+	case OutputPEM:
+		key, err := os.ReadFile(paths.Key)
+		if err != nil {
+			return nil, err
+		}
+		fullChain, err := os.ReadFile(paths.FullChain)
+		if err != nil {
+			return nil, err
+		}
+		var b bytes.Buffer
+		b.Write(key)
+		if len(key) != 0 && key[len(key)-1] != '\n' {
+			b.WriteByte('\n')
+		}
+		b.Write(fullChain)
+		return b.Bytes(), nil
+	case OutputPKCS12:
+		keyData, err := os.ReadFile(paths.Key)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePrivateKey(keyData)
+		if err != nil {
+			return nil, err
+		}
+		fullChain, err := os.ReadFile(paths.FullChain)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parseCerts(fullChain)
+		if err != nil {
+			return nil, err
+		}
+		return pkcs12.Modern.Encode(key, certs[0], certs[1:], o.Password)
+	default:
+		panic("unknown OutputType")
+	}
+}
+
+// Deploy writes the output atomically, with the configured ownership and
+// mode.
+func (o *Output) Deploy(paths *CertPaths, domain string) error {
+	name, err := o.ResolvePath(domain)
+	if err != nil {
+		return err
+	}
+	data, err := o.content(paths)
+	if err != nil {
+		return err
+	}
+	uid, gid, err := o.ids()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	err = util.WriteFileAtomic(name, data, o.perm(), uid, gid)
+	if err != nil {
+		return err
+	}
+	slog.Debug("acme output deployed", "type", o.Type, "path", name, "domain", domain)
+	return nil
+}
+
+// deployOutputs deploys all the outputs, even those deployed before, so that
+// they are up to date with their parameters.
+func deployOutputs(outputs []*Output, paths *CertPaths, domain string) error {
+	var errs []error
+	for _, o := range outputs {
+		err := o.Deploy(paths, domain)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to deploy %s output: %w", o.Type, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parsePrivateKey(data []byte) (any, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to parse private key as pem")
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func parseCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
@@ -0,0 +1,144 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hgl/acmehugger/internal/util"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestOutput(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyData, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyData = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyData})
+	crt := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{"a.com"},
+	}
+	crtData, err := x509.CreateCertificate(rand.Reader, crt, crt, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crtData = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crtData})
+	paths, err := newCertPaths(dir, "a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(paths.Key, keyData, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(paths.FullChain, crtData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(paths.Chain, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := t.TempDir()
+	pemOut := &Output{Type: OutputPEM, Path: outDir + "/$domain.pem"}
+	p12Out := &Output{Type: OutputPKCS12, Path: outDir + "/sub/a.p12"}
+	err = p12Out.ParseParams([]string{"password=secret", "mode=0640"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyOut := &Output{Type: OutputFullChain, Path: outDir + "/fullchain.crt"}
+	err = deployOutputs([]*Output{pemOut, p12Out, copyOut}, paths, "a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := util.ReadText(filepath.Join(outDir, "a.com.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := string(keyData) + string(crtData); got != want {
+		t.Errorf("pem output = %q, want %q", got, want)
+	}
+	fi, err := os.Stat(filepath.Join(outDir, "a.com.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := os.FileMode(0600); fi.Mode().Perm() != want {
+		t.Errorf("pem output mode = %v, want %v", fi.Mode().Perm(), want)
+	}
+
+	data, err := os.ReadFile(p12Out.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12Key, p12Crt, err := pkcs12.Decode(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(p12Key) {
+		t.Errorf("pkcs12 key doesn't match")
+	}
+	if p12Crt.DNSNames[0] != "a.com" {
+		t.Errorf("pkcs12 certificate domain = %s, want a.com", p12Crt.DNSNames[0])
+	}
+	fi, err = os.Stat(p12Out.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := os.FileMode(0640); fi.Mode().Perm() != want {
+		t.Errorf("pkcs12 output mode = %v, want %v", fi.Mode().Perm(), want)
+	}
+
+	got, err = util.ReadText(copyOut.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(crtData) {
+		t.Errorf("fullchain output = %q, want %q", got, crtData)
+	}
+
+	// existing outputs are refreshed with changed parameters
+	err = p12Out.ParseParams([]string{"password=changed", "mode=0600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deployOutputs([]*Output{p12Out}, paths, "a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(p12Out.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = pkcs12.Decode(data, "changed")
+	if err != nil {
+		t.Errorf("pkcs12 output should be refreshed with the changed password: %v", err)
+	}
+	fi, err = os.Stat(p12Out.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := os.FileMode(0600); fi.Mode().Perm() != want {
+		t.Errorf("refreshed pkcs12 output mode = %v, want %v", fi.Mode().Perm(), want)
+	}
+
+	err = (&Output{Type: OutputKey}).ParseParams([]string{"password=x"})
+	if err == nil {
+		t.Errorf("password should be rejected for non-pkcs12 outputs")
+	}
+}
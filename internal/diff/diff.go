@@ -0,0 +1,154 @@
+// Package diff produces line-based unified diffs.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around changes.
+const context = 3
+
+type op int
+
+const (
+	opEqual op = iota
+	opDelete
+	opInsert
+)
+
+type edit struct {
+	op   op
+	line string
+	// a and b are the 0-based line numbers in the old and new texts.
+	a, b int
+}
+
+// Unified returns the unified diff from oldText to newText, or an empty
+// string if they are equal.
+func Unified(oldName string, newName string, oldText string, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+	edits := lineEdits(splitLines(oldText), splitLines(newText))
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+	for start := 0; start < len(edits); {
+		// find the next change
+		for start < len(edits) && edits[start].op == opEqual {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		// extend the hunk until there are more than 2*context unchanged lines
+		end := start
+		for i := start; i < len(edits); i++ {
+			if edits[i].op != opEqual {
+				end = i + 1
+				continue
+			}
+			if i-end >= 2*context {
+				break
+			}
+		}
+		lo := max(start-context, 0)
+		hi := min(end+context, len(edits))
+		writeHunk(&b, edits[lo:hi])
+		start = hi
+	}
+	return b.String()
+}
+
+func writeHunk(b *strings.Builder, edits []edit) {
+	var aStart, aLen, bStart, bLen int
+	aStart, bStart = -1, -1
+	for _, e := range edits {
+		if e.op != opInsert {
+			if aStart == -1 {
+				aStart = e.a
+			}
+			aLen++
+		}
+		if e.op != opDelete {
+			if bStart == -1 {
+				bStart = e.b
+			}
+			bLen++
+		}
+	}
+	// an empty range starts at the line before it
+	if aStart == -1 {
+		aStart = edits[0].a - 1
+	}
+	if bStart == -1 {
+		bStart = edits[0].b - 1
+	}
+	fmt.Fprintf(b, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+	for _, e := range edits {
+		switch e.op {
+		case opEqual:
+			b.WriteByte(' ')
+		case opDelete:
+			b.WriteByte('-')
+		case opInsert:
+			b.WriteByte('+')
+		}
+		b.WriteString(e.line)
+		if !strings.HasSuffix(e.line, "\n") {
+			b.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(start int, n int) string {
+	if n == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// splitLines splits text into lines, each of which keeps its newline.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineEdits returns the edits turning a into b, based on their longest common
+// subsequence.
+func lineEdits(a []string, b []string) []edit {
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{opEqual, a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{opDelete, a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{opInsert, b[j], i, j})
+			j++
+		}
+	}
+	return edits
+}
@@ -0,0 +1,173 @@
+// Package metrics implements a registry of metrics exposed in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metric families, and serves them over HTTP.
+type Registry struct {
+	families []*Family
+	mu       sync.Mutex
+}
+
+func New() *Registry {
+	return &Registry{}
+}
+
+// Counter adds a family of counters, whose samples are distinguished by
+// the values of labels.
+func (r *Registry) Counter(name string, help string, labels ...string) *Family {
+	return r.add(name, "counter", help, labels)
+}
+
+func (r *Registry) Gauge(name string, help string, labels ...string) *Family {
+	return r.add(name, "gauge", help, labels)
+}
+
+// Summary adds a family of summaries, which only track the sum and count of
+// observed values.
+func (r *Registry) Summary(name string, help string, labels ...string) *Family {
+	return r.add(name, "summary", help, labels)
+}
+
+func (r *Registry) add(name string, typ string, help string, labels []string) *Family {
+	f := &Family{
+		reg:     r,
+		name:    name,
+		typ:     typ,
+		help:    help,
+		labels:  labels,
+		samples: make(map[string]*sample),
+	}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+// Family is a metric with samples for different label values.
+type Family struct {
+	reg     *Registry
+	name    string
+	typ     string
+	help    string
+	labels  []string
+	samples map[string]*sample
+}
+
+type sample struct {
+	values []string
+	value  float64
+	count  uint64
+}
+
+// sample returns the sample for the label values, which must be as many as
+// the family's labels. The registry must be locked.
+func (f *Family) sample(values []string) *sample {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s requires %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\x00")
+	s := f.samples[key]
+	if s == nil {
+		s = &sample{values: slices.Clone(values)}
+		f.samples[key] = s
+	}
+	return s
+}
+
+// Add adds v to the sample of the label values.
+func (f *Family) Add(v float64, values ...string) {
+	f.reg.mu.Lock()
+	defer f.reg.mu.Unlock()
+	f.sample(values).value += v
+}
+
+func (f *Family) Inc(values ...string) {
+	f.Add(1, values...)
+}
+
+func (f *Family) Set(v float64, values ...string) {
+	f.reg.mu.Lock()
+	defer f.reg.mu.Unlock()
+	f.sample(values).value = v
+}
+
+// Observe adds v to the sum of a summary, and increments its count.
+func (f *Family) Observe(v float64, values ...string) {
+	f.reg.mu.Lock()
+	defer f.reg.mu.Unlock()
+	s := f.sample(values)
+	s.value += v
+	s.count++
+}
+
+// Reset removes all samples.
+func (f *Family) Reset() {
+	f.reg.mu.Lock()
+	defer f.reg.mu.Unlock()
+	clear(f.samples)
+}
+
+// WriteText writes all metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+	for _, f := range r.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+		keys := make([]string, 0, len(f.samples))
+		for key := range f.samples {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			s := f.samples[key]
+			labels := f.formatLabels(s.values)
+			if f.typ == "summary" {
+				fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, labels, formatValue(s.value))
+				fmt.Fprintf(&b, "%s_count%s %d\n", f.name, labels, s.count)
+				continue
+			}
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, labels, formatValue(s.value))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *Family) formatLabels(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, f.labels[i], labelReplacer.Replace(v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
@@ -0,0 +1,73 @@
+// Package sdnotify implements the systemd service notification protocol.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Reloading returns the state of reloading, which systemd requires to carry
+// the time of CLOCK_MONOTONIC, if the service type is notify-reload.
+func Reloading() string {
+	s := "RELOADING=1"
+	if usec, ok := monotonicUsec(); ok {
+		s += "\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10)
+	}
+	return s
+}
+
+func Status(s string) string {
+	return "STATUS=" + s
+}
+
+// Enabled reports whether nginxh runs as a service that expects
+// notifications.
+func Enabled() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// Notify sends the states to the service manager. It does nothing if
+// NOTIFY_SOCKET is not set.
+func Notify(states ...string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// a leading @ means an abstract socket, which net handles
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// don't block if the service manager is not reading
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	return err
+}
+
+// WatchdogInterval returns how often Watchdog should be sent, which is half
+// of the timeout set by the service manager, or 0 if the watchdog is not
+// enabled for this process.
+func WatchdogInterval() time.Duration {
+	s := os.Getenv("WATCHDOG_USEC")
+	if s == "" {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package sdnotify
+
+import "golang.org/x/sys/unix"
+
+// monotonicUsec returns the time of CLOCK_MONOTONIC in microseconds.
+func monotonicUsec() (int64, bool) {
+	var ts unix.Timespec
+	err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	if err != nil {
+		return 0, false
+	}
+	return ts.Nano() / 1000, true
+}
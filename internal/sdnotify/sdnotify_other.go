@@ -0,0 +1,9 @@
+//go:build !linux
+
+package sdnotify
+
+// monotonicUsec reports false, since only systemd needs the time, which
+// runs on linux.
+func monotonicUsec() (int64, bool) {
+	return 0, false
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"io/fs"
 	"os"
+	"path/filepath"
 )
 
 func Pointer[T any](s T) *T {
@@ -36,6 +38,94 @@ func ForceSymlink(oldname, newname string) error {
 	return os.Symlink(oldname, newname)
 }
 
+// WriteFileAtomic writes data to a temporary file in the same directory as
+// name, syncs it and renames it over name, so readers never observe a
+// partially written file. uid and gid are applied when not -1.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode, uid, gid int) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(perm)
+	if err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		err = f.Chown(uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// SymlinkAtomic makes newname a symlink to oldname, replacing any existing
+// one atomically.
+func SymlinkAtomic(oldname, newname string) error {
+	tmp := newname + ".tmp"
+	err := os.Remove(tmp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.Symlink(oldname, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, newname)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return SyncDir(filepath.Dir(newname))
+}
+
+// SyncDir flushes the directory entry to disk.
+func SyncDir(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// SyncTree flushes all files and directories under root to disk.
+func SyncTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() && !d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Sync()
+	})
+}
+
 func ReadText(name string) (string, error) {
 	data, err := os.ReadFile(name)
 	if err != nil {
@@ -1,8 +1,12 @@
 package nginx
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hgl/acmehugger/acme"
@@ -12,33 +16,32 @@ import (
 )
 
 func (tr *Tree) PrepareACME() (*ACMEProcessor, error) {
+	err := tr.validateACME()
+	if err != nil {
+		return nil, err
+	}
 	extractor := &acmeExtractor{
 		NoopVisitor: NoopVisitor{},
 	}
-	err := tr.Accept(extractor)
+	err = tr.Accept(extractor)
 	if err != nil {
 		return nil, err
 	}
 	if extractor.hasHTTP01 {
 		if extractor.httpBlock == nil {
 			blk := NewBlockDirective("http", []string{})
-			tr.conf.Children = append(tr.conf.Children, blk)
+			tr.conf.Append(blk)
 			extractor.httpBlock = blk
 		}
 		if len(extractor.httpServerBlocks) == 0 {
 			blk := NewBlockDirective("server", []string{})
-			extractor.httpBlock.Children = append(extractor.httpBlock.Children, blk)
-			extractor.httpServerBlocks = []*serverBlock{&serverBlock{
-				http: true,
-				dire: blk,
-			}}
+			extractor.httpBlock.Append(blk)
+			s := &serverBlock{module: "http", dire: blk}
+			s.addListen(&Listen{Port: DefaultListenPort, EndPort: DefaultListenPort})
+			extractor.httpServerBlocks = []*serverBlock{s}
 		}
-		for _, s := range extractor.httpServerBlocks {
-			s.dire.Children = append(s.dire.Children,
-				NewDirective("location", []string{`/.well-known/acme-challenge/`},
-					NewDirective("root", []string{acme.ChallengeDir}),
-				),
-			)
+		for _, s := range extractor.challengeServers() {
+			s.addChallengeLocation()
 		}
 	}
 	for _, s := range extractor.httpsServerBlocks {
@@ -51,7 +54,7 @@ func (tr *Tree) PrepareACME() (*ACMEProcessor, error) {
 			return nil, err
 		}
 		if !exist {
-			if !s.http {
+			if !s.plain {
 				deferred := &DeferredDirective{s.dire}
 				s.dire.ReplaceWith(deferred)
 				s.deferredBlk = deferred
@@ -67,9 +70,10 @@ func (tr *Tree) PrepareACME() (*ACMEProcessor, error) {
 		"httpsServersLen", len(extractor.httpsServerBlocks),
 	)
 	return &ACMEProcessor{
-		tr:        tr,
-		extractor: extractor,
-		stopped:   make(chan struct{}),
+		tr:            tr,
+		extractor:     extractor,
+		stopped:       make(chan struct{}),
+		statusChanged: make(chan struct{}, 1),
 	}, nil
 }
 
@@ -78,8 +82,81 @@ type ACMEProcessor struct {
 	extractor *acmeExtractor
 	stopped   chan struct{}
 	changed   chan *ACMEChangeInfo
+	wg        sync.WaitGroup
+	// certs are the certificates required by the blocks, in the order of
+	// the blocks
+	certs         []*managedCert
+	certsMu       sync.Mutex
+	statusChanged chan struct{}
+	// resumed is not nil while issuing is paused, and closed when resumed
+	resumed chan struct{}
+	metrics *Metrics
+}
+
+type certState int
+
+const (
+	certPending certState = iota
+	certReady
+	certFailing
+)
+
+func (s certState) String() string {
+	switch s {
+	case certPending:
+		return "pending"
+	case certReady:
+		return "ready"
+	case certFailing:
+		return "failing"
+	default:
+		panic("unknown certState")
+	}
+}
+
+// managedCert is a certificate required by a server or acme block. Its
+// state is guarded by ACMEProcessor.certsMu.
+type managedCert struct {
+	block     *BlockDirective
+	domains   []string
+	acct      *acme.Account
+	issueOpts *acme.IssueOptions
+	state     certState
+	// err is the error of the last failure, kept until issuing succeeds
+	err      error
+	notAfter time.Time
+	renewAt  time.Time
+	// renew receives when renewal is forced
+	renew chan struct{}
+}
+
+// CertStatus counts certificates in each state.
+type CertStatus struct {
+	// Ready certificates are issued or renewed successfully.
+	Ready int
+	// Pending certificates are not issued yet.
+	Pending int
+	// Failing certificates failed to be issued or renewed last time.
+	Failing int
 }
 
+// CertInfo describes a certificate required by a server or acme block.
+type CertInfo struct {
+	// Block is the location of the block.
+	Block   string   `json:"block"`
+	Domains []string `json:"domains"`
+	Server  string   `json:"server"`
+	// State is "pending", "ready" or "failing".
+	State string `json:"state"`
+	// NotAfter and RenewAt are nil until the certificate is issued.
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+	RenewAt  *time.Time `json:"renewAt,omitempty"`
+	// Error is the last error of issuing, kept until it succeeds.
+	Error string `json:"error,omitempty"`
+}
+
+var ErrCertNotFound = errors.New("no certificate for the domain")
+
 type ACMEChangeInfo struct {
 	Block       *BlockDirective
 	TreeChanged bool
@@ -88,49 +165,65 @@ type ACMEChangeInfo struct {
 	Domains     []string
 }
 
+// SetMetrics makes issuances recorded in m. It must be called before
+// Process.
+func (p *ACMEProcessor) SetMetrics(m *Metrics) {
+	p.metrics = m
+}
+
 func (p *ACMEProcessor) Process() <-chan *ACMEChangeInfo {
 	p.changed = make(chan *ACMEChangeInfo)
-	for _, s := range p.extractor.httpsServerBlocks {
-		go p.processServerBlock(s)
+	servers := make([]*managedCert, len(p.extractor.httpsServerBlocks))
+	for i, s := range p.extractor.httpsServerBlocks {
+		servers[i] = p.addCert(s.dire, s.domains, s.acct, s.issueOpts)
+	}
+	acmes := make([]*managedCert, len(p.extractor.acmeBlocks))
+	for i, a := range p.extractor.acmeBlocks {
+		acmes[i] = p.addCert(a.dire, a.domains, a.acct, a.issueOpts)
 	}
-	for _, a := range p.extractor.acmeBlocks {
-		go p.processACMEBlock(a)
+	for i, s := range p.extractor.httpsServerBlocks {
+		p.wg.Add(1)
+		go func(s *serverBlock, c *managedCert) {
+			defer p.wg.Done()
+			p.processServerBlock(s, c)
+		}(s, servers[i])
+	}
+	for _, c := range acmes {
+		p.wg.Add(1)
+		go func(c *managedCert) {
+			defer p.wg.Done()
+			p.processACMEBlock(c)
+		}(c)
 	}
 	return p.changed
 }
 
-func (p *ACMEProcessor) processServerBlock(s *serverBlock) {
-	var issuer *acme.Issuer
-	var err error
-	for {
-		issuer, err = acme.GetIssuer(s.acct)
-		if err != nil {
-			slog.Error("failed to prepare issuing, retry in an hour", "error", err)
-			t := clock.NewTimer(time.Hour)
-			select {
-			case <-p.stopped:
-				t.Stop()
-				return
-			case <-t.C():
-				continue
-			}
-		}
-		break
+func (p *ACMEProcessor) addCert(b *BlockDirective, domains []string, acct *acme.Account, opts *acme.IssueOptions) *managedCert {
+	c := &managedCert{
+		block:     b,
+		domains:   domains,
+		acct:      acct,
+		issueOpts: opts,
+		renew:     make(chan struct{}, 1),
 	}
+	p.certs = append(p.certs, c)
+	return c
+}
 
+func (p *ACMEProcessor) processServerBlock(s *serverBlock, c *managedCert) {
+	forced := false
+	issuer := p.getIssuer(c, &forced)
+	if issuer == nil {
+		return
+	}
 	firstRun := true
 	for {
-		info, err := issuer.Issue(s.domains, s.issueOpts)
-		if err != nil {
-			slog.Error("failed to issue, retry in an hour", "error", err)
-			t := clock.NewTimer(time.Hour)
-			select {
-			case <-p.stopped:
-				t.Stop()
-				return
-			case <-t.C():
-				continue
-			}
+		info, ok := p.issue(issuer, c, &forced)
+		if !ok {
+			return
+		}
+		if info == nil {
+			continue
 		}
 		hacct := issuer.HandlerAccount()
 		if firstRun {
@@ -140,103 +233,329 @@ func (p *ACMEProcessor) processServerBlock(s *serverBlock) {
 					s.replaceDeferDirectives()
 					s.ensureSSLDirectives(info.CertPaths)
 				})
-				go func() {
-					p.changed <- &ACMEChangeInfo{
-						Block:       s.dire,
-						TreeChanged: true,
-						Server:      hacct.Server,
-						Email:       hacct.Email,
-						Domains:     s.domains,
-					}
-				}()
-			}
-		} else if info.Changed {
-			go func() {
-				p.changed <- &ACMEChangeInfo{
+				p.send(&ACMEChangeInfo{
 					Block:       s.dire,
-					TreeChanged: false,
+					TreeChanged: true,
 					Server:      hacct.Server,
 					Email:       hacct.Email,
 					Domains:     s.domains,
-				}
-			}()
+				})
+			}
+		} else if info.Changed {
+			p.send(&ACMEChangeInfo{
+				Block:       s.dire,
+				TreeChanged: false,
+				Server:      hacct.Server,
+				Email:       hacct.Email,
+				Domains:     s.domains,
+			})
 		}
 
-		select {
-		case <-p.stopped:
-			info.RenewTimer.Stop()
+		forced, ok = p.waitRenew(issuer, c, info)
+		if !ok {
 			return
-		case <-info.RenewTimer.C():
-			continue
 		}
 	}
 }
 
-func (p *ACMEProcessor) processACMEBlock(a *acmeBlock) {
-	var issuer *acme.Issuer
-	var err error
+func (p *ACMEProcessor) processACMEBlock(c *managedCert) {
+	forced := false
+	issuer := p.getIssuer(c, &forced)
+	if issuer == nil {
+		return
+	}
 	for {
-		issuer, err = acme.GetIssuer(a.acct)
-		if err != nil {
-			slog.Error("failed to prepare issuing, retry in an hour", "error", err)
-			t := clock.NewTimer(time.Hour)
-			select {
-			case <-p.stopped:
-				t.Stop()
-				return
-			case <-t.C():
-				continue
-			}
+		info, ok := p.issue(issuer, c, &forced)
+		if !ok {
+			return
+		}
+		if info == nil {
+			continue
+		}
+		if info.Changed {
+			hacct := issuer.HandlerAccount()
+			p.send(&ACMEChangeInfo{
+				Block:       c.block,
+				TreeChanged: false,
+				Server:      hacct.Server,
+				Email:       hacct.Email,
+				Domains:     c.domains,
+			})
+		}
+
+		forced, ok = p.waitRenew(issuer, c, info)
+		if !ok {
+			return
 		}
-		break
 	}
+}
+
+// getIssuer returns the issuer of the certificate, retrying hourly if it
+// fails, or once renewal is forced, which sets *forced. It returns nil if
+// the processor is stopped.
+func (p *ACMEProcessor) getIssuer(c *managedCert, forced *bool) *acme.Issuer {
 	for {
-		info, err := issuer.Issue(a.domains, a.issueOpts)
-		if err != nil {
-			slog.Error("failed to issue, retry in an hour", "error", err)
-			t := clock.NewTimer(time.Hour)
-			select {
-			case <-p.stopped:
-				t.Stop()
-				return
-			case <-t.C():
-				continue
-			}
+		issuer, err := acme.GetIssuer(c.acct)
+		if err == nil {
+			return issuer
 		}
+		slog.Error("failed to prepare issuing, retry in an hour", "error", err)
+		p.metrics.accountFailed(c.acct)
+		p.setCertState(c, certFailing, err)
+		var ok bool
+		*forced, ok = p.sleep(c, clock.NewTimer(time.Hour))
+		if !ok {
+			return nil
+		}
+	}
+}
 
-		if info.Changed {
-			hacct := issuer.HandlerAccount()
-			go func() {
-				p.changed <- &ACMEChangeInfo{
-					Block:       a.dire,
-					TreeChanged: false,
-					Server:      hacct.Server,
-					Email:       hacct.Email,
-					Domains:     a.domains,
-				}
-			}()
+// issue issues or renews the certificate, waiting first if issuing is
+// paused, unless *forced is true. If it fails, it waits for an hour, or
+// until renewal is forced, and returns a nil info. It reports false if the
+// processor is stopped.
+func (p *ACMEProcessor) issue(issuer *acme.Issuer, c *managedCert, forced *bool) (*acme.IssueInfo, bool) {
+	if !*forced {
+		var ok bool
+		*forced, ok = p.waitResumed(c)
+		if !ok {
+			return nil, false
 		}
+	}
+	var info *acme.IssueInfo
+	var err error
+	if *forced {
+		slog.Info("renewal forced", "domains", c.domains)
+		info, err = issuer.Renew(c.domains, c.issueOpts)
+	} else {
+		info, err = issuer.Issue(c.domains, c.issueOpts)
+	}
+	p.metrics.issued(c.acct, c.issueOpts, info, err)
+	if err != nil {
+		slog.Error("failed to issue, retry in an hour", "error", err)
+		p.setCertState(c, certFailing, err)
+		var ok bool
+		*forced, ok = p.sleep(c, clock.NewTimer(time.Hour))
+		return nil, ok
+	}
+	p.certsMu.Lock()
+	c.notAfter = info.NotAfter
+	c.renewAt = info.RenewAt
+	// the certificates of a stopped processor are replaced by a new one's
+	select {
+	case <-p.stopped:
+	default:
+		p.metrics.certIssued(c.acct, c.domains, info)
+	}
+	p.certsMu.Unlock()
+	p.setCertState(c, certReady, info.DeployErr)
+	return info, true
+}
 
+// waitRenew waits until the certificate is due for renewal, or renewal is
+// forced, which it reports. Meanwhile, outputs that failed to deploy are
+// deployed again hourly. It reports false if the processor is stopped.
+func (p *ACMEProcessor) waitRenew(issuer *acme.Issuer, c *managedCert, info *acme.IssueInfo) (forced bool, ok bool) {
+	err := info.DeployErr
+	for err != nil {
+		slog.Error("failed to deploy outputs, retry in an hour", "error", err, "domains", c.domains)
+		retry := clock.NewTimer(time.Hour)
 		select {
 		case <-p.stopped:
+			retry.Stop()
 			info.RenewTimer.Stop()
-			return
+			return false, false
+		case <-c.renew:
+			retry.Stop()
+			info.RenewTimer.Stop()
+			return true, true
 		case <-info.RenewTimer.C():
+			retry.Stop()
+			return false, true
+		case <-retry.C():
+		}
+		err = issuer.Deploy(c.domains, c.issueOpts)
+		p.setCertState(c, certReady, err)
+	}
+	return p.sleep(c, info.RenewTimer)
+}
+
+// sleep waits for the timer, or until renewal is forced, which it reports.
+// It reports false if the processor is stopped.
+func (p *ACMEProcessor) sleep(c *managedCert, t clock.Timer) (forced bool, ok bool) {
+	select {
+	case <-p.stopped:
+		t.Stop()
+		return false, false
+	case <-c.renew:
+		t.Stop()
+		return true, true
+	case <-t.C():
+		return false, true
+	}
+}
+
+// waitResumed waits while issuing is paused, or until renewal is forced,
+// which it reports. It reports false if the processor is stopped.
+func (p *ACMEProcessor) waitResumed(c *managedCert) (forced bool, ok bool) {
+	p.certsMu.Lock()
+	resumed := p.resumed
+	p.certsMu.Unlock()
+	if resumed == nil {
+		return false, true
+	}
+	slog.Info("issuing paused", "domains", c.domains)
+	select {
+	case <-p.stopped:
+		return false, false
+	case <-c.renew:
+		return true, true
+	case <-resumed:
+		return false, true
+	}
+}
+
+// Pause pauses issuing and renewing certificates until Resume is called.
+// Issuances in progress are not interrupted, and forced renewals still
+// happen.
+func (p *ACMEProcessor) Pause() {
+	p.certsMu.Lock()
+	defer p.certsMu.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+}
+
+func (p *ACMEProcessor) Resume() {
+	p.certsMu.Lock()
+	defer p.certsMu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+// Renew forces renewing the certificate for the domain, even if it hasn't
+// reached its renew time.
+func (p *ACMEProcessor) Renew(domain string) error {
+	for _, c := range p.certs {
+		if !slices.Contains(c.domains, domain) {
 			continue
 		}
+		select {
+		case c.renew <- struct{}{}:
+		default:
+			// a renewal is already requested
+		}
+		return nil
 	}
+	return fmt.Errorf("%w: %s", ErrCertNotFound, domain)
 }
 
+func (p *ACMEProcessor) setCertState(c *managedCert, state certState, err error) {
+	p.certsMu.Lock()
+	changed := c.state != state
+	c.state = state
+	if err != nil || state == certReady {
+		c.err = err
+	}
+	p.certsMu.Unlock()
+	if changed {
+		select {
+		case p.statusChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// CertStatus returns the current status of certificates.
+func (p *ACMEProcessor) CertStatus() CertStatus {
+	p.certsMu.Lock()
+	defer p.certsMu.Unlock()
+	var status CertStatus
+	for _, c := range p.certs {
+		switch c.state {
+		case certReady:
+			status.Ready++
+		case certPending:
+			status.Pending++
+		case certFailing:
+			status.Failing++
+		}
+	}
+	return status
+}
+
+// Certs returns the certificates being issued and renewed.
+func (p *ACMEProcessor) Certs() []CertInfo {
+	p.certsMu.Lock()
+	defer p.certsMu.Unlock()
+	infos := make([]CertInfo, len(p.certs))
+	for i, c := range p.certs {
+		info := CertInfo{
+			Block:   c.block.Location(),
+			Domains: c.domains,
+			Server:  c.acct.ResolveServer(),
+			State:   c.state.String(),
+		}
+		if !c.notAfter.IsZero() {
+			notAfter, renewAt := c.notAfter, c.renewAt
+			info.NotAfter = &notAfter
+			info.RenewAt = &renewAt
+		}
+		if c.err != nil {
+			info.Error = c.err.Error()
+		}
+		infos[i] = info
+	}
+	return infos
+}
+
+// StatusChanged returns a channel that receives when CertStatus changes.
+func (p *ACMEProcessor) StatusChanged() <-chan struct{} {
+	return p.statusChanged
+}
+
+// send sends the change without blocking the caller. It's dropped if the
+// processor is stopped before the change is received.
+func (p *ACMEProcessor) send(info *ACMEChangeInfo) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		select {
+		case p.changed <- info:
+		case <-p.stopped:
+		}
+	}()
+}
+
+// Stop stops issuing and renewing. Issuances in progress are not
+// interrupted, and the channel returned by Process is closed once they
+// finish.
 func (p *ACMEProcessor) Stop() {
-	close(p.changed)
+	// certificates are no longer recorded in metrics once it returns
+	p.certsMu.Lock()
 	close(p.stopped)
+	p.certsMu.Unlock()
+	if p.changed == nil {
+		return
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.changed)
+	}()
 }
 
 type serverBlock struct {
-	http                   bool
+	module                 string // name of the block containing the server
+	names                  []string
+	listens                []*Listen
+	plain                  bool // has a listener that needs no certificate
+	http01                 bool // can answer the HTTP01 challenge
 	https                  bool
 	domains                []string
 	domainsFromACMEDomains bool
+	domainsDire            *SimpleDirective
 	acct                   *acme.Account
 	issueOpts              *acme.IssueOptions
 	deferredBlk            *DeferredDirective
@@ -246,22 +565,34 @@ type serverBlock struct {
 	sslTrustedCertificate  *SimpleDirective
 }
 
+func (s *serverBlock) addListen(l *Listen) {
+	s.listens = append(s.listens, l)
+	if l.NeedsCert() {
+		s.https = true
+	} else {
+		s.plain = true
+	}
+	if s.module == "http" && l.ServesHTTP01() {
+		s.http01 = true
+	}
+}
+
 func (s *serverBlock) ensureSSLDirectives(paths *acme.CertPaths) {
 	if s.sslCertificate == nil {
 		s.sslCertificate = NewDirective("ssl_certificate", []string{paths.FullChain}).(*SimpleDirective)
-		s.dire.Children = append(s.dire.Children, s.sslCertificate)
+		s.dire.Append(s.sslCertificate)
 	} else {
 		s.sslCertificate.SetArg(0, paths.FullChain)
 	}
 	if s.sslCertificateKey == nil {
 		s.sslCertificateKey = NewDirective("ssl_certificate_key", []string{paths.Key}).(*SimpleDirective)
-		s.dire.Children = append(s.dire.Children, s.sslCertificateKey)
+		s.dire.Append(s.sslCertificateKey)
 	} else {
 		s.sslCertificateKey.SetArg(0, paths.Key)
 	}
 	if s.sslTrustedCertificate == nil {
 		s.sslTrustedCertificate = NewDirective("ssl_trusted_certificate", []string{paths.Chain}).(*SimpleDirective)
-		s.dire.Children = append(s.dire.Children, s.sslTrustedCertificate)
+		s.dire.Append(s.sslTrustedCertificate)
 	} else {
 		s.sslTrustedCertificate.SetArg(0, paths.Chain)
 	}
@@ -281,19 +612,22 @@ func (s *serverBlock) replaceDeferDirectives() {
 }
 
 type acmeBlock struct {
-	domains   []string
-	acct      *acme.Account
-	issueOpts *acme.IssueOptions
-	dire      *BlockDirective
+	domains     []string
+	domainsDire *SimpleDirective
+	acct        *acme.Account
+	issueOpts   *acme.IssueOptions
+	dire        *BlockDirective
 }
 
 type acmeExtractor struct {
 	NoopVisitor
 	tr                *Tree
 	blockDepth        int
+	module            string
 	visitedDires      set.Set[string]
 	acctStack         stack.Stack[*acme.Account]
 	issueOptsStack    stack.Stack[*acme.IssueOptions]
+	outputsSetStack   stack.Stack[bool]
 	serverBlock       *serverBlock
 	httpServerBlocks  []*serverBlock
 	httpsServerBlocks []*serverBlock
@@ -310,50 +644,78 @@ func (f *acmeExtractor) VisitTreeBegin(tr *Tree) error {
 	f.acctStack = stack.Stack[*acme.Account]{&acct}
 	var opts acme.IssueOptions
 	f.issueOptsStack = stack.Stack[*acme.IssueOptions]{&opts}
+	f.outputsSetStack = stack.Stack[bool]{false}
 	return nil
 }
 
 func (f *acmeExtractor) VisitBlockBegin(d *BlockDirective) error {
 	f.blockDepth++
-	if f.blockDepth >= 3 {
-		return SkipLevel
-	}
-	switch d.Name() {
-	case "http", "server", "acme":
-		acct := f.acctStack.MustPeek().Clone()
-		f.acctStack.Push(acct)
-		issueOpts := f.issueOptsStack.MustPeek().Clone()
-		f.issueOptsStack.Push(issueOpts)
-	default:
+	if !f.extracts(d, f.blockDepth) {
 		return SkipLevel
 	}
+	acct := f.acctStack.MustPeek().Clone()
+	f.acctStack.Push(acct)
+	issueOpts := f.issueOptsStack.MustPeek().Clone()
+	f.issueOptsStack.Push(issueOpts)
+	f.outputsSetStack.Push(false)
 	switch d.Name() {
+	case "http", "stream", "mail":
+		f.module = d.Name()
 	case "server":
-		f.serverBlock = &serverBlock{}
+		f.serverBlock = &serverBlock{module: f.module}
 	case "acme":
 		f.acmeBlock = &acmeBlock{}
 	}
 	return nil
 }
 
+// extracts reports whether the block at depth can contain acme directives.
+func (f *acmeExtractor) extracts(d *BlockDirective, depth int) bool {
+	switch d.Name() {
+	case "http", "stream", "mail", "acme":
+		return depth == 1
+	case "server":
+		return depth == 2 && f.module != ""
+	default:
+		return false
+	}
+}
+
 func (f *acmeExtractor) VisitBlockEnd(d *BlockDirective) error {
+	depth := f.blockDepth
 	f.blockDepth--
 	f.visitedDires.Clear()
+	if !f.extracts(d, depth) {
+		return nil
+	}
 	switch d.Name() {
-	case "http":
+	case "http", "stream", "mail":
 		f.acctStack.MustPop()
 		f.issueOptsStack.MustPop()
-		f.httpBlock = d
+		f.outputsSetStack.MustPop()
+		if d.Name() == "http" {
+			f.httpBlock = d
+		}
+		f.module = ""
 	case "server":
 		acct := f.acctStack.MustPop()
 		issueOpts := f.issueOptsStack.MustPop()
-		if f.serverBlock.http {
+		f.outputsSetStack.MustPop()
+		if f.serverBlock.module == "http" && len(f.serverBlock.listens) == 0 {
+			// nginx listens on port 80 by default, if started by root
+			f.serverBlock.addListen(&Listen{Port: DefaultListenPort, EndPort: DefaultListenPort})
+		}
+		f.serverBlock.dire = d
+		if f.serverBlock.http01 {
 			f.httpServerBlocks = append(f.httpServerBlocks, f.serverBlock)
 		}
 		if f.serverBlock.https && len(f.serverBlock.domains) != 0 {
+			err := requireDNSForWildcard(f.serverBlock.domains, f.serverBlock.domainsDire, issueOpts)
+			if err != nil {
+				return err
+			}
 			f.serverBlock.acct = acct
 			f.serverBlock.issueOpts = issueOpts
-			f.serverBlock.dire = d
 			f.httpsServerBlocks = append(f.httpsServerBlocks, f.serverBlock)
 			if issueOpts.Challenge == acme.ChallengeHTTP {
 				f.hasHTTP01 = true
@@ -363,6 +725,11 @@ func (f *acmeExtractor) VisitBlockEnd(d *BlockDirective) error {
 	case "acme":
 		acct := f.acctStack.MustPop()
 		issueOpts := f.issueOptsStack.MustPop()
+		f.outputsSetStack.MustPop()
+		err := requireDNSForWildcard(f.acmeBlock.domains, f.acmeBlock.domainsDire, issueOpts)
+		if err != nil {
+			return err
+		}
 		f.acmeBlock.acct = acct
 		f.acmeBlock.issueOpts = issueOpts
 		f.acmeBlock.dire = d
@@ -382,41 +749,51 @@ func (p *acmeExtractor) VisitDirective(dire Directive) error {
 		return nil
 	}
 
-	// TODO: check uniq
 	switch d.Name() {
 	case "listen":
 		if p.serverBlock == nil {
 			return nil
 		}
-		https := slices.Contains(d.args[1:], "ssl")
-		if https {
-			p.serverBlock.https = true
-		} else {
-			p.serverBlock.http = true
+		l, err := d.ListenArg()
+		if err != nil {
+			return err
 		}
+		p.serverBlock.addListen(l)
 		return nil
-	case "server_name":
-		if p.serverBlock == nil {
+	case "starttls":
+		if p.serverBlock == nil || p.serverBlock.module != "mail" {
 			return nil
 		}
-		if p.serverBlock.domainsFromACMEDomains {
+		on, err := d.OneArg()
+		if err != nil {
+			return err
+		}
+		if on == "off" {
+			return nil
+		}
+		// nginx refuses to start if STARTTLS is enabled without a
+		// certificate, so it's deferred like acme_defer until one exists.
+		p.serverBlock.https = true
+		d.ReplaceWith(&DeferredDirective{d})
+		return nil
+	case "server_name":
+		if p.serverBlock == nil {
 			return nil
 		}
 		_, err := d.OnePlusArgs()
 		if err != nil {
 			return err
 		}
-		domains := make([]string, 0, len(d.Args()))
-		for _, domain := range d.Args() {
-			if domain == "" {
-				continue
-			}
-			if domain[0] == '~' {
-				return nil
-			}
-			domains = append(domains, domain)
+		p.serverBlock.names = d.Args()
+		if p.serverBlock.domainsFromACMEDomains {
+			return nil
+		}
+		domains, ok := serverNameDomains(d.Args())
+		if !ok {
+			return nil
 		}
 		p.serverBlock.domains = domains
+		p.serverBlock.domainsDire = d
 		return nil
 	case "acme_email":
 		email, err := d.OneArg()
@@ -500,6 +877,42 @@ func (p *acmeExtractor) VisitDirective(dire Directive) error {
 		(*o)[k] = v
 		d.Delete()
 		return nil
+	case "acme_output_pem", "acme_output_pkcs12":
+		args, err := d.OnePlusArgs()
+		if err != nil {
+			return err
+		}
+		o := &acme.Output{Type: acme.OutputPEM, Path: args[0]}
+		if d.Name() == "acme_output_pkcs12" {
+			o.Type = acme.OutputPKCS12
+		}
+		err = o.ParseParams(args[1:])
+		if err != nil {
+			return fmt.Errorf("%s: %w in %s", d.Name(), err, d.Location())
+		}
+		p.addOutput(o)
+		d.Delete()
+		return nil
+	case "acme_output_copy":
+		args, err := d.OnePlusArgs()
+		if err != nil {
+			return err
+		}
+		if len(args) < 2 {
+			return fmt.Errorf("%s requires a type and a path in %s", d.Name(), d.Location())
+		}
+		t, err := acme.ParseOutputCopyType(args[0])
+		if err != nil {
+			return fmt.Errorf("%s: %w in %s", d.Name(), err, d.Location())
+		}
+		o := &acme.Output{Type: t, Path: args[1]}
+		err = o.ParseParams(args[2:])
+		if err != nil {
+			return fmt.Errorf("%s: %w in %s", d.Name(), err, d.Location())
+		}
+		p.addOutput(o)
+		d.Delete()
+		return nil
 	case "acme_domain":
 		if p.acmeBlock == nil && p.serverBlock == nil {
 			return nil
@@ -508,10 +921,13 @@ func (p *acmeExtractor) VisitDirective(dire Directive) error {
 		if err != nil {
 			return err
 		}
+		domains = uniqDomains(domains)
 		if p.acmeBlock != nil {
 			p.acmeBlock.domains = domains
+			p.acmeBlock.domainsDire = d
 		} else if p.serverBlock != nil {
 			p.serverBlock.domains = domains
+			p.serverBlock.domainsDire = d
 			p.serverBlock.domainsFromACMEDomains = true
 		}
 		d.Delete()
@@ -523,25 +939,88 @@ func (p *acmeExtractor) VisitDirective(dire Directive) error {
 		}
 		dd := newDeferredDirective(d)
 		if dd.Name() == "listen" {
-			https := slices.Contains(dd.Args()[1:], "ssl")
-			if https {
-				p.serverBlock.https = true
-			} else {
-				p.serverBlock.http = true
+			l, err := dd.Directive.(*SimpleDirective).ListenArg()
+			if err != nil {
+				return err
 			}
+			p.serverBlock.addListen(l)
 		}
 		d.ReplaceWith(dd)
 		return nil
 	case "ssl_certificate":
-		p.serverBlock.sslCertificate = d
+		if p.serverBlock != nil {
+			p.serverBlock.sslCertificate = d
+		}
 		return nil
 	case "ssl_certificate_key":
-		p.serverBlock.sslCertificateKey = d
+		if p.serverBlock != nil {
+			p.serverBlock.sslCertificateKey = d
+		}
 		return nil
 	case "ssl_trusted_certificate":
-		p.serverBlock.sslTrustedCertificate = d
+		if p.serverBlock != nil {
+			p.serverBlock.sslTrustedCertificate = d
+		}
 		return nil
 	default:
 		return nil
 	}
 }
+
+// addOutput follows nginx's inheritance of array directives: outputs are
+// inherited from the outer level only if the current level defines none.
+func (p *acmeExtractor) addOutput(o *acme.Output) {
+	opts := p.issueOptsStack.MustPeek()
+	if !p.outputsSetStack.MustPeek() {
+		opts.Outputs = nil
+		p.outputsSetStack[len(p.outputsSetStack)-1] = true
+	}
+	opts.Outputs = append(opts.Outputs, o)
+}
+
+// serverNameDomains translates server names to ACME identifiers. The
+// ".example.com" form is translated to "example.com" and "*.example.com". ok
+// is false if any name is a regular expression or has a trailing wildcard,
+// which can't be used as ACME identifiers.
+func serverNameDomains(names []string) (domains []string, ok bool) {
+	domains = make([]string, 0, len(names))
+	for _, name := range names {
+		switch {
+		case name == "":
+			continue
+		case name[0] == '~', strings.HasSuffix(name, ".*"):
+			return nil, false
+		case name[0] == '.':
+			domains = append(domains, name[1:], "*"+name)
+		default:
+			domains = append(domains, name)
+		}
+	}
+	return uniqDomains(domains), true
+}
+
+func uniqDomains(domains []string) []string {
+	seen := make(set.Set[string], len(domains))
+	uniq := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if seen.AddNew(domain) {
+			uniq = append(uniq, domain)
+		}
+	}
+	return uniq
+}
+
+// requireDNSForWildcard switches to the DNS01 challenge if any domain is a
+// wildcard, since it's the only challenge that can validate them.
+func requireDNSForWildcard(domains []string, dire *SimpleDirective, opts *acme.IssueOptions) error {
+	if !slices.ContainsFunc(domains, func(domain string) bool {
+		return strings.HasPrefix(domain, "*.")
+	}) {
+		return nil
+	}
+	if opts.DNS.Name == "" {
+		return fmt.Errorf("wildcard domains require a DNS provider set with acme_dns in %s", dire.Location())
+	}
+	opts.Challenge = acme.ChallengeDNS
+	return nil
+}
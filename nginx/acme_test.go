@@ -6,9 +6,12 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
+	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -52,20 +55,10 @@ func TestACME(t *testing.T) {
 				return nil
 			},
 			issue: func(acct *acme.HandlerAccount, domains []string, io *acme.IssueOptions) (*acme.Cert, error) {
-				crt := &x509.Certificate{
-					SerialNumber: big.NewInt(1),
-					NotAfter:     clock.Now().Add(time.Duration(acme.DefaultDays+1) * 24 * time.Hour),
-					DNSNames:     domains,
-				}
-				crtKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-				if err != nil {
-					t.Fatal(err)
-				}
-				crtData, err := x509.CreateCertificate(rand.Reader, crt, crt, &crtKey.PublicKey, crtKey)
+				crtData, err := selfSignedCert(domains, clock.Now().Add(time.Duration(acme.DefaultDays+1)*24*time.Hour))
 				if err != nil {
-					t.Fatal(err)
+					return nil, err
 				}
-				crtData = pem.EncodeToMemory(&pem.Block{Bytes: crtData})
 				return &acme.Cert{
 					FullChain: crtData,
 				}, nil
@@ -85,6 +78,200 @@ func TestACME(t *testing.T) {
 	}
 }
 
+func TestWildcardDomains(t *testing.T) {
+	acme.AccountsDir = t.TempDir()
+	tr := parseText(t, `http {
+	acme_dns cloudflare;
+	acme_challenge http;
+	server {
+		acme_defer listen 443 ssl;
+		server_name .a.com a.com b.com;
+	}
+	server {
+		listen 443 ssl;
+		server_name www.c.*;
+	}
+}
+`)
+	ap, err := tr.PrepareACME()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := ap.extractor.httpsServerBlocks
+	if len(servers) != 1 {
+		t.Fatalf("got %d https servers, want 1", len(servers))
+	}
+	if want := []string{"a.com", "*.a.com", "b.com"}; !slices.Equal(servers[0].domains, want) {
+		t.Errorf("domains = %v, want %v", servers[0].domains, want)
+	}
+	if servers[0].issueOpts.Challenge != acme.ChallengeDNS {
+		t.Errorf("wildcard domains should use the DNS01 challenge")
+	}
+	if ap.extractor.hasHTTP01 {
+		t.Errorf("wildcard domains should not need the HTTP01 challenge")
+	}
+
+	tr = parseText(t, `http {
+	server {
+		acme_defer listen 443 ssl;
+		server_name *.a.com;
+	}
+}
+`)
+	_, err = tr.PrepareACME()
+	if err == nil || !strings.HasSuffix(err.Error(), tr.Config().Path()+":4:3") {
+		t.Errorf("got error %v, want one located at server_name", err)
+	}
+}
+
+func TestDeployError(t *testing.T) {
+	acme.AccountsDir = t.TempDir()
+	acme.CertsDir = t.TempDir()
+	acme.ChallengeDir = t.TempDir()
+	acme.SetDefaultHandler(&handlerStub{
+		createAccount: func(acct *acme.HandlerAccount) error {
+			return nil
+		},
+		issue: issueSelfSigned,
+	})
+	// a file is in the way of the output
+	outDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(outDir, "sub"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := parseText(t, fmt.Sprintf(`http {
+	server {
+		acme_defer listen 443 ssl;
+		acme_domain a.com;
+		acme_output_pem %s/sub/a.pem;
+	}
+}
+`, outDir))
+	ap, err := tr.PrepareACME()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := <-ap.Process()
+	ap.Stop()
+	if !info.TreeChanged {
+		t.Errorf("the server should be undeferred even if outputs fail to deploy")
+	}
+	certs := ap.Certs()
+	if certs[0].State != "ready" || certs[0].Error == "" {
+		t.Errorf("certificate should be ready with the deploy error, got %+v", certs[0])
+	}
+}
+
+func TestForcedAfterAccountError(t *testing.T) {
+	acme.AccountsDir = t.TempDir()
+	acme.CertsDir = t.TempDir()
+	acme.ChallengeDir = t.TempDir()
+	acme.SetDefaultHandler(&handlerStub{
+		createAccount: func(acct *acme.HandlerAccount) error {
+			return errors.New("account error")
+		},
+		// the key is kept after failing to create the account
+		recoverAccount: func(acct *acme.HandlerAccount) error {
+			return nil
+		},
+		issue: issueSelfSigned,
+	})
+	tr := parseText(t, `acme {
+	acme_domain a.com;
+}
+`)
+	ap, err := tr.PrepareACME()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap.Pause()
+	changed := ap.Process()
+	for i := 0; ap.Certs()[0].State != "failing"; i++ {
+		if i == 500 {
+			t.Fatal("timed out waiting for the account to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// forced renewals happen even if paused
+	err = ap.Renew("a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forced renewal should not wait for resuming")
+	}
+	ap.Stop()
+}
+
+func parseText(t *testing.T, text string) *Tree {
+	name := filepath.Join(t.TempDir(), "nginx.conf")
+	err := os.WriteFile(name, []byte(text), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Parse(name, filepath.Dir(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// selfSignedCert returns a PEM encoded self-signed certificate for the
+// domains, which expires at notAfter.
+func selfSignedCert(domains []string, notAfter time.Time) ([]byte, error) {
+	crt := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     notAfter,
+		DNSNames:     domains,
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err := x509.CreateCertificate(rand.Reader, crt, crt, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: data}), nil
+}
+
+// issueSelfSigned issues self-signed certificates expiring in 60 days, as
+// the issue function of handlerStub.
+func issueSelfSigned(acct *acme.HandlerAccount, domains []string, opts *acme.IssueOptions) (*acme.Cert, error) {
+	data, err := selfSignedCert(domains, time.Now().Add(60*24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	return &acme.Cert{FullChain: data}, nil
+}
+
+// writeNginx writes a shell script standing in for nginx, which passes
+// config tests with -t and otherwise runs script, and the config conf next
+// to it. ConfOutDir is set to a temporary directory. It returns the paths of
+// the script and the config.
+func writeNginx(t *testing.T, script string, conf string) (string, string) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "nginx")
+	err := os.WriteFile(bin, []byte(`#!/bin/sh
+for arg; do
+	[ "$arg" = -t ] && exit 0
+done
+`+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "nginx.conf")
+	err = os.WriteFile(name, []byte(conf), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ConfOutDir = t.TempDir()
+	return bin, name
+}
+
 func compareTree(t *testing.T, tr *Tree, name string, target string) {
 	outDir := t.TempDir()
 	_, err := tr.Dump(outDir)
@@ -0,0 +1,119 @@
+package nginx
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/hgl/acmehugger/acme"
+)
+
+const challengePath = "/.well-known/acme-challenge/"
+
+// challengeServers returns the servers that can receive HTTP01 challenges:
+// those whose names match a domain validated with HTTP01, and the default
+// servers of port 80, which receive requests for names no server matches.
+func (f *acmeExtractor) challengeServers() []*serverBlock {
+	var domains []string
+	for _, s := range f.httpsServerBlocks {
+		if s.issueOpts.Challenge == acme.ChallengeHTTP {
+			domains = append(domains, s.domains...)
+		}
+	}
+	for _, a := range f.acmeBlocks {
+		if a.issueOpts.Challenge == acme.ChallengeHTTP {
+			domains = append(domains, a.domains...)
+		}
+	}
+
+	defaults := make(map[string]*serverBlock)
+	firsts := make(map[string]*serverBlock)
+	for _, s := range f.httpServerBlocks {
+		for _, l := range s.listens {
+			if !l.ServesHTTP01() {
+				continue
+			}
+			addr := l.Address
+			if _, ok := firsts[addr]; !ok {
+				firsts[addr] = s
+			}
+			if _, ok := defaults[addr]; !ok && l.DefaultServer {
+				defaults[addr] = s
+			}
+		}
+	}
+	for addr, s := range firsts {
+		if _, ok := defaults[addr]; !ok {
+			defaults[addr] = s
+		}
+	}
+
+	var servers []*serverBlock
+	for _, s := range f.httpServerBlocks {
+		isDefault := slices.ContainsFunc(s.listens, func(l *Listen) bool {
+			return l.ServesHTTP01() && defaults[l.Address] == s
+		})
+		if isDefault || s.matchesAny(domains) {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+func (s *serverBlock) matchesAny(domains []string) bool {
+	for _, name := range s.names {
+		for _, domain := range domains {
+			if serverNameMatches(name, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serverNameMatches reports whether nginx would select a server named name
+// for requests to domain. Regular expressions are matched with Go's syntax,
+// which covers the common subset of PCRE.
+func serverNameMatches(name string, domain string) bool {
+	name = strings.ToLower(name)
+	domain = strings.ToLower(domain)
+	switch {
+	case name == "":
+		return false
+	case name[0] == '~':
+		re, err := regexp.Compile(name[1:])
+		return err == nil && re.MatchString(domain)
+	case name[0] == '.':
+		return domain == name[1:] || strings.HasSuffix(domain, name)
+	case strings.HasPrefix(name, "*."):
+		return strings.HasSuffix(domain, name[1:])
+	case strings.HasSuffix(name, ".*"):
+		return strings.HasPrefix(domain, name[:len(name)-1])
+	default:
+		return name == domain
+	}
+}
+
+// rewriteDirectives are the server-level directives that are run before a
+// location is selected, and can redirect challenge requests away.
+var rewriteDirectives = []string{"rewrite", "return", "break", "if"}
+
+// addChallengeLocation makes the server serve challenge files. If the server
+// has rewrite directives, they are skipped for challenge requests by a
+// leading break, so the directives themselves are kept as they are.
+func (s *serverBlock) addChallengeLocation() {
+	if slices.ContainsFunc(s.dire.Children, func(d Directive) bool {
+		return slices.Contains(rewriteDirectives, d.Name())
+	}) {
+		s.dire.Prepend(
+			NewDirective("if", []string{"($uri", "~", "^" + regexp.QuoteMeta(challengePath) + ")"},
+				NewDirective("break", nil),
+			),
+		)
+	}
+	s.dire.Append(
+		NewDirective("location", []string{"^~", challengePath},
+			NewDirective("root", []string{acme.ChallengeDir}),
+		),
+	)
+}
@@ -0,0 +1,29 @@
+package nginx
+
+import "testing"
+
+func TestServerNameMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		want   bool
+	}{
+		{"a.com", "a.com", true},
+		{"A.com", "a.com", true},
+		{"a.com", "b.a.com", false},
+		{"*.a.com", "b.a.com", true},
+		{"*.a.com", "a.com", false},
+		{".a.com", "a.com", true},
+		{".a.com", "b.c.a.com", true},
+		{"www.a.*", "www.a.org", true},
+		{`~^(www\.)?a\.com$`, "www.a.com", true},
+		{`~^b\.`, "a.com", false},
+		{"", "a.com", false},
+		{"_", "a.com", false},
+	}
+	for _, test := range tests {
+		if got := serverNameMatches(test.name, test.domain); got != test.want {
+			t.Errorf("serverNameMatches(%q, %q) = %v, want %v", test.name, test.domain, got, test.want)
+		}
+	}
+}
@@ -2,16 +2,21 @@ package nginx
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"os"
-	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
-	"syscall"
+	"slices"
+	"time"
 
 	"github.com/hgl/acmehugger"
-	"github.com/hgl/acmehugger/acme"
+	"github.com/hgl/acmehugger/internal/diff"
+	"github.com/hgl/acmehugger/internal/util"
 )
 
 func parseArgs(bin string, args []string) (conf string, nbin string, nargs []string, err error) {
@@ -57,6 +62,19 @@ func Start() error {
 		h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
 		slog.SetDefault(slog.New(h))
 	}
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		return Fmt(os.Args[2:], os.Stdin, os.Stdout)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		return ShowPlan(os.Args[2:], os.Stdout)
+	}
+	if s := os.Getenv("ACMEHUGGER_RELOAD_WINDOW"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid ACMEHUGGER_RELOAD_WINDOW: %w", err)
+		}
+		ReloadWindow = d
+	}
 	conf, bin, args, err := parseArgs(os.Getenv("NGINXBIN"), os.Args[1:])
 	if err != nil {
 		return err
@@ -64,99 +82,179 @@ func Start() error {
 	if len(args) == 1 && args[0] == "-h" {
 		fmt.Printf(`nginxh version: %s %s/%s
 Usage: nginxh [nginx option] ...
+       nginxh fmt [-w] [-d] [file] ...
+       nginxh plan [-c file]
 
+-t and -T test the generated config, and -s signals the running nginxh.
 Run 'nginx -h' for more information on nginx options.
+Run 'nginxh fmt -h' for more information on formatting configs.
+Run 'nginxh plan' to show what nginxh does with the configs.
 `, acmehugger.Version, runtime.GOOS, runtime.GOARCH)
 		return nil
 	}
 	slog.Debug("nginx args parsed", "conf", conf, "bin", bin, "args", args)
+	if sig, ok := optionValue(args, 's'); ok {
+		return signalRunning(sig)
+	}
+	if hasOption(args, 't') || hasOption(args, 'T') {
+		tr, err := Parse(conf, ConfDir)
+		if err != nil {
+			return err
+		}
+		return TestConfig(tr, bin, args)
+	}
 
-	var hup = make(chan os.Signal, 1)
-	signal.Notify(hup, syscall.SIGHUP)
+	if hasOption(args, 'v') || hasOption(args, 'V') {
+		return runNginx(bin, args)
+	}
+	// refuse early, though the PID file is written once nginx is started
+	err = checkPidFile()
+	if err != nil {
+		return err
+	}
 
-	var tr *Tree
-	var inst *Instance
-	var ap *ACMEProcessor
-	render := func() error {
-		var err error
-		if tr == nil {
-			tr, err = Parse(conf, ConfDir)
-		} else {
-			err = tr.Parse()
+	sidecar := os.Getenv("ACMEHUGGER_SIDECAR") != ""
+	ready := daemonizedReady()
+	if ready == nil && !sidecar {
+		daemon, err := willDaemonize(conf, args)
+		if err != nil {
+			return err
+		}
+		if daemon {
+			return daemonize()
 		}
+	}
+
+	var watcher *confWatcher
+	if os.Getenv("ACMEHUGGER_WATCH") != "" {
+		watcher, err = newConfWatcher()
 		if err != nil {
 			return err
 		}
-		ap, err = tr.PrepareACME()
+		defer watcher.Close()
+	}
+	var m *Metrics
+	if addr := os.Getenv("ACMEHUGGER_METRICS_ADDR"); addr != "" {
+		var ln net.Listener
+		m, ln, err = serveMetrics(addr)
 		if err != nil {
 			return err
 		}
-		if inst == nil {
-			inst, err = StartInstance(tr, bin, args)
-			if err != nil {
-				return err
-			}
-			go func() {
-				err := inst.Wait()
-				if err != nil {
-					slog.Error("nginx exited unexpectedly", "error", err)
-				} else {
-					slog.Error(`nginx exited unexpectedly, did you forget to specifiy -g "daemon off;"?`)
-				}
-				code := ExitCode(err)
-				if code == 0 {
-					code = 1
-				}
-				os.Exit(code)
-			}()
-		} else {
-			err = inst.Reload(tr)
-			if err != nil {
-				return err
-			}
+		defer ln.Close()
+	}
+	r := newRunner(conf, bin, args, watcher)
+	r.ready = ready
+	r.sidecar = sidecar
+	r.supervise = os.Getenv("ACMEHUGGER_SUPERVISE") != ""
+	r.reloadCmd = os.Getenv("ACMEHUGGER_RELOAD_COMMAND")
+	r.metrics = m
+	r.writePid = true
+	if os.Getenv("ACMEHUGGER_CONTROL") != "" {
+		ln, err := listenControl(ControlSocket)
+		if err != nil {
+			return err
 		}
+		defer ln.Close()
+		go r.serveControl(ln)
+	}
+	return r.run()
+}
 
-		changed := ap.Process()
-	inner:
-		for {
-			select {
-			case info := <-changed:
-				var err error
-				switch info.Block.name {
-				case "server":
-					if info.TreeChanged {
-						err = inst.Reload(info.Block.Tree())
-					} else {
-						err = inst.Reload(nil)
-					}
-					if err != nil {
-						slog.Error("failed to reload nginx", "error", err)
-						continue
-					}
-				}
-				err = acme.CallHooks(&acme.HookInfo{
-					Server:  info.Server,
-					Email:   info.Email,
-					Domains: info.Domains,
-				})
-				if err != nil {
-					continue
-				}
-			case <-hup:
-				slog.Debug("SIGHUP received, reloading config")
-				ap.Stop()
-				// TODO: remove all previously generated confs
-				break inner
-			}
-		}
+// willDaemonize reports whether nginx will run as a daemon, in which case
+// nginxh daemonizes itself too.
+func willDaemonize(conf string, args []string) (bool, error) {
+	// avoid parsing configs if possible, so that config errors are
+	// reported as usual in the foreground
+	if g, ok := optionValue(args, 'g'); ok && daemonOffRegexp.MatchString(g) {
+		return false, nil
+	}
+	tr, err := Parse(conf, ConfDir)
+	if err != nil {
+		return false, err
+	}
+	return isDaemon(tr, args)
+}
+
+var daemonOffRegexp = regexp.MustCompile(`(^|[;\s])daemon\s+off\s*;`)
+
+var ErrNotFormatted = errors.New("configs are not formatted")
+
+// Fmt formats the config files in args, or stdin if there is none. The
+// results are written to stdout, unless -w or -d is given. With -d, diffs
+// are written instead, and ErrNotFormatted is returned if there is any.
+func Fmt(args []string, stdin io.Reader, stdout io.Writer) error {
+	fset := flag.NewFlagSet("nginxh fmt", flag.ContinueOnError)
+	write := fset.Bool("w", false, "write results to the files instead of stdout")
+	showDiff := fset.Bool("d", false, "write diffs instead of results, and fail if any file is not formatted")
+	err := fset.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	names := fset.Args()
+	if len(names) == 0 {
+		if *write {
+			return errors.New("cannot use -w with stdin")
+		}
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		return fmtFile("<stdin>", string(data), false, *showDiff, stdout)
+	}
+	var errs []error
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = fmtFile(name, string(data), *write, *showDiff, stdout)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if slices.Contains(errs, ErrNotFormatted) {
+		// report it once, at the end
+		errs = slices.DeleteFunc(errs, func(err error) bool {
+			return err == ErrNotFormatted
+		})
+		errs = append(errs, ErrNotFormatted)
+	}
+	return errors.Join(errs...)
+}
 
-	for {
-		err = render()
+func fmtFile(name string, text string, write bool, showDiff bool, stdout io.Writer) error {
+	formatted, err := Format(name, text)
+	if err != nil {
+		return err
+	}
+	if write && formatted != text {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		err = util.WriteFileAtomic(name, []byte(formatted), fi.Mode().Perm(), -1, -1)
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case showDiff:
+		d := diff.Unified(name, name+" (formatted)", text, formatted)
+		if d == "" {
+			return nil
+		}
+		_, err = io.WriteString(stdout, d)
 		if err != nil {
-			slog.Error("failed to reload config", "error", err)
-			<-hup
+			return err
 		}
+		return ErrNotFormatted
+	case !write:
+		_, err = io.WriteString(stdout, formatted)
+		return err
 	}
+	return nil
 }
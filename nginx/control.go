@@ -0,0 +1,245 @@
+package nginx
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var errStopped = errors.New("nginxh is stopping")
+
+// listenControl listens on the unix socket name, which only the user and
+// group of nginxh can connect to.
+func listenControl(name string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is created in a private directory, and only appears under
+	// its name once its permissions are set
+	dir, err := os.MkdirTemp(filepath.Dir(name), ".nginxh-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, filepath.Base(name))
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, 0660)
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &controlListener{Listener: ln, name: name}, nil
+}
+
+// controlListener removes the socket when closed.
+type controlListener struct {
+	net.Listener
+	name string
+}
+
+func (l *controlListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.name)
+	return err
+}
+
+// serveControl serves the control API on the listener, until it's closed.
+func (r *runner) serveControl(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/certs", r.handleCerts)
+	mux.HandleFunc("/renew", r.handleRenew)
+	mux.HandleFunc("/reload", r.handleReload)
+	mux.HandleFunc("/rollback", r.handleRollback)
+	mux.HandleFunc("/pause", r.handlePause)
+	mux.HandleFunc("/resume", r.handlePause)
+	err := http.Serve(ln, mux)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Error("failed to serve control API", "error", err)
+	}
+}
+
+// control runs fn in the runner's goroutine, which owns its state. It
+// reports false if the runner has stopped.
+func (r *runner) control(fn func()) bool {
+	done := make(chan struct{})
+	select {
+	case r.controlC <- func() {
+		fn()
+		close(done)
+	}:
+	case <-r.stopped:
+		return false
+	}
+	<-done
+	return true
+}
+
+// certsResponse is the response of GET /certs.
+type certsResponse struct {
+	Paused bool       `json:"paused"`
+	Certs  []CertInfo `json:"certs"`
+}
+
+func (r *runner) handleCerts(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	resp := certsResponse{Certs: []CertInfo{}}
+	ok := r.control(func() {
+		resp.Paused = r.paused
+		if r.ap != nil {
+			resp.Certs = r.ap.Certs()
+		}
+	})
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, errStopped)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (r *runner) handleRenew(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	var body struct {
+		Domain string `json:"domain"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err == nil && body.Domain == "" {
+		err = errors.New("domain is required")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ok := r.control(func() {
+		err = ErrCertNotFound
+		if r.ap != nil {
+			err = r.ap.Renew(body.Domain)
+		}
+	})
+	switch {
+	case !ok:
+		writeError(w, http.StatusServiceUnavailable, errStopped)
+	case errors.Is(err, ErrCertNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		slog.Info("renewal requested", "domain", body.Domain)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (r *runner) handleReload(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	var err error
+	ok := r.control(func() {
+		slog.Debug("reload requested, reloading config")
+		r.rerender()
+		err = r.renderErr
+	})
+	switch {
+	case !ok:
+		writeError(w, http.StatusServiceUnavailable, errStopped)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (r *runner) handleRollback(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	var err error
+	ok := r.control(func() {
+		if r.inst == nil {
+			err = errors.New("nginx is not running")
+			return
+		}
+		slog.Info("rollback requested, reloading the previous config version")
+		err = r.inst.Rollback()
+	})
+	switch {
+	case !ok:
+		writeError(w, http.StatusServiceUnavailable, errStopped)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handlePause handles both /pause and /resume.
+func (r *runner) handlePause(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	paused := req.URL.Path == "/pause"
+	ok := r.control(func() {
+		r.setPaused(paused)
+	})
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, errStopped)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPaused pauses or resumes issuing and renewing certificates, including
+// those in configs reloaded later.
+func (r *runner) setPaused(paused bool) {
+	if paused == r.paused {
+		return
+	}
+	r.paused = paused
+	if paused {
+		slog.Info("certificate renewals paused")
+	} else {
+		slog.Info("certificate renewals resumed")
+	}
+	if r.ap == nil {
+		return
+	}
+	if paused {
+		r.ap.Pause()
+	} else {
+		r.ap.Resume()
+	}
+}
+
+func allowMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,185 @@
+package nginx
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hgl/acmehugger/acme"
+)
+
+func TestControl(t *testing.T) {
+	acme.AccountsDir = t.TempDir()
+	acme.CertsDir = t.TempDir()
+	acme.ChallengeDir = t.TempDir()
+	var issued atomic.Int32
+	acme.SetDefaultHandler(&handlerStub{
+		createAccount: func(acct *acme.HandlerAccount) error {
+			return nil
+		},
+		issue: func(acct *acme.HandlerAccount, domains []string, opts *acme.IssueOptions) (*acme.Cert, error) {
+			issued.Add(1)
+			return issueSelfSigned(acct, domains, opts)
+		},
+	})
+
+	// runs until the stop file exists, and ignores reloads
+	bin, conf := writeNginx(t, `trap '' HUP
+while [ ! -e "$0.stop" ]; do
+	sleep 0.05
+done
+`, `daemon off;
+events {}
+acme {
+	acme_domain a.com;
+}
+`)
+
+	r := newRunner(conf, bin, nil, nil)
+	sock := filepath.Join(t.TempDir(), "nginxh.sock")
+	ln, err := listenControl(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0660 {
+		t.Errorf("socket mode = %v, want %v", mode, os.FileMode(0660))
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(sock)); len(entries) != 1 {
+		t.Errorf("socket directory should only contain the socket, got %v", entries)
+	}
+	go r.serveControl(ln)
+	runErr := make(chan error)
+	go func() {
+		runErr <- r.run()
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx stdcontext.Context, network string, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+	request := func(method string, path string, body string) (int, string) {
+		req, err := http.NewRequest(method, "http://nginxh"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(data)
+	}
+	certs := func() certsResponse {
+		status, body := request("GET", "/certs", "")
+		if status != http.StatusOK {
+			t.Fatalf("GET /certs: status = %d, body = %s", status, body)
+		}
+		var resp certsResponse
+		err := json.Unmarshal([]byte(body), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	waitFor := func(what string, cond func() bool) {
+		for i := 0; !cond(); i++ {
+			if i == 500 {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("the certificate to be issued", func() bool {
+		resp := certs()
+		return len(resp.Certs) == 1 && resp.Certs[0].State == "ready"
+	})
+	cert := certs().Certs[0]
+	if cert.Domains[0] != "a.com" || cert.NotAfter == nil || cert.RenewAt == nil || cert.Error != "" {
+		t.Errorf("unexpected certificate %+v", cert)
+	}
+
+	if status, _ := request("POST", "/pause", ""); status != http.StatusNoContent {
+		t.Errorf("POST /pause: status = %d", status)
+	}
+	if !certs().Paused {
+		t.Errorf("renewals should be paused")
+	}
+	// forced renewals happen even if paused
+	if status, body := request("POST", "/renew", `{"domain":"a.com"}`); status != http.StatusAccepted {
+		t.Errorf("POST /renew: status = %d, body = %s", status, body)
+	}
+	waitFor("the certificate to be renewed", func() bool {
+		return issued.Load() == 2
+	})
+	if status, _ := request("POST", "/renew", `{"domain":"b.com"}`); status != http.StatusNotFound {
+		t.Errorf("renewing an unknown domain: status = %d, want %d", status, http.StatusNotFound)
+	}
+	if status, _ := request("GET", "/renew", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET /renew: status = %d, want %d", status, http.StatusMethodNotAllowed)
+	}
+	if status, _ := request("POST", "/resume", ""); status != http.StatusNoContent {
+		t.Errorf("POST /resume: status = %d", status)
+	}
+	if status, body := request("POST", "/reload", ""); status != http.StatusNoContent {
+		t.Errorf("POST /reload: status = %d, body = %s", status, body)
+	}
+	resp := certs()
+	if resp.Paused || len(resp.Certs) != 1 {
+		t.Errorf("unexpected certificates after reloading %+v", resp)
+	}
+	var versions []int
+	r.control(func() {
+		versions, err = r.inst.versions.Versions()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) < 2 {
+		t.Fatalf("config versions = %v, want at least 2", versions)
+	}
+	if status, body := request("POST", "/rollback", ""); status != http.StatusNoContent {
+		t.Errorf("POST /rollback: status = %d, body = %s", status, body)
+	}
+	var cur int
+	r.control(func() {
+		cur, err = r.inst.versions.Current()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := versions[len(versions)-2]; cur != want {
+		t.Errorf("current version after rolling back = %d, want %d", cur, want)
+	}
+
+	err = os.WriteFile(bin+".stop", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-runErr
+	if status, _ := request("GET", "/certs", ""); status != http.StatusServiceUnavailable {
+		t.Errorf("GET /certs after stopping: status = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if n := issued.Load(); n != 2 {
+		t.Errorf("issued %d times, want 2", n)
+	}
+}
@@ -0,0 +1,207 @@
+package nginx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DaemonPollInterval is how often a daemonized nginx is checked for exiting.
+var DaemonPollInterval = time.Second
+
+// mainDirective returns the directive name in the main context, set either
+// in the configs or with the -g option in args.
+func mainDirective(tr *Tree, args []string, name string) (Directive, error) {
+	var children []Directive
+	if g, ok := optionValue(args, 'g'); ok {
+		_, ds, err := parseSnippet("the -g option", g)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, ds...)
+	}
+	children = append(children, flattenIncludes(tr.conf.Children)...)
+	i := slices.IndexFunc(children, func(d Directive) bool {
+		return d.Name() == name
+	})
+	if i == -1 {
+		return nil, nil
+	}
+	d := children[i]
+	if len(d.Args()) != 1 {
+		return nil, fmt.Errorf("invalid number of arguments in %q directive in %s", name, d.Location())
+	}
+	return d, nil
+}
+
+// isDaemon reports whether nginx runs as a daemon, which it does unless
+// "daemon off;" is given.
+func isDaemon(tr *Tree, args []string) (bool, error) {
+	if runtime.GOOS == "windows" {
+		return false, nil
+	}
+	d, err := mainDirective(tr, args, "daemon")
+	if err != nil {
+		return false, err
+	}
+	return d == nil || d.Args()[0] != "off", nil
+}
+
+var buildOptionRegexp = regexp.MustCompile(`--(prefix|pid-path)=(\S+)`)
+
+// pidFile returns the path of the file in which nginx writes the PID of its
+// master process.
+func pidFile(tr *Tree, bin string, args []string) (string, error) {
+	d, err := mainDirective(tr, args, "pid")
+	if err != nil {
+		return "", err
+	}
+	name := ""
+	if d != nil {
+		name = d.Args()[0]
+	}
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	prefix, hasPrefix := optionValue(args, 'p')
+	if name != "" && hasPrefix {
+		return filepath.Join(prefix, name), nil
+	}
+
+	// fall back to the paths nginx is built with
+	cmd := exec.Command(bin, "-V")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("failed to get nginx build options: %w", err)
+	}
+	opts := map[string]string{
+		"prefix":   "/usr/local/nginx",
+		"pid-path": "logs/nginx.pid",
+	}
+	for _, m := range buildOptionRegexp.FindAllStringSubmatch(out.String(), -1) {
+		opts[m[1]] = strings.Trim(m[2], `'"`)
+	}
+	if name == "" {
+		name = opts["pid-path"]
+	}
+	if !hasPrefix {
+		prefix = opts["prefix"]
+	}
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	return filepath.Join(prefix, name), nil
+}
+
+// readPidFile returns the PID in the file, if it's modified after since.
+func readPidFile(name string, since time.Time) (int, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	if fi.ModTime().Before(since.Truncate(time.Second)) {
+		return 0, fmt.Errorf("stale PID file: %s", name)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid PID file: %s", name)
+	}
+	return pid, nil
+}
+
+// daemonProcess is the master process of a daemonized nginx, which is not a
+// child of nginxh.
+type daemonProcess struct {
+	pidFile string
+	proc    *os.Process
+	started time.Time
+	mu      sync.Mutex
+}
+
+// startDaemon runs nginx, which exits once it has forked the master process,
+// and finds the master process from the PID file.
+func startDaemon(cmd *exec.Cmd, pidFile string) (*daemonProcess, error) {
+	started := time.Now()
+	// the master process may inherit stderr, don't wait for it to be closed
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+		return nil, err
+	}
+	// the master process writes the PID file after forking
+	var pid int
+	for i := 0; ; i++ {
+		pid, err = readPidFile(pidFile, started)
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			return nil, fmt.Errorf("failed to find the nginx master process: %w", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	return &daemonProcess{
+		pidFile: pidFile,
+		proc:    proc,
+		started: started,
+	}, nil
+}
+
+func (p *daemonProcess) Pid() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.proc.Pid
+}
+
+func (p *daemonProcess) Signal(sig os.Signal) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.proc.Signal(sig)
+}
+
+// Wait polls the master process until it exits. If the PID file then refers
+// to a new master process, as after upgrading the binary, it's followed
+// instead.
+func (p *daemonProcess) Wait() error {
+	for {
+		time.Sleep(DaemonPollInterval)
+		if p.Signal(syscall.Signal(0)) == nil {
+			continue
+		}
+		pid, err := readPidFile(p.pidFile, p.started)
+		if err != nil || pid == p.Pid() {
+			return nil
+		}
+		proc, err := os.FindProcess(pid)
+		if err != nil || proc.Signal(syscall.Signal(0)) != nil {
+			return nil
+		}
+		slog.Debug("nginx master process changed", "from", p.Pid(), "to", pid)
+		p.mu.Lock()
+		p.proc = proc
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,128 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsDaemon(t *testing.T) {
+	tests := []struct {
+		conf string
+		args []string
+		want bool
+	}{
+		{"events {}\n", nil, true},
+		{"daemon on;\nevents {}\n", nil, true},
+		{"daemon off;\nevents {}\n", nil, false},
+		{"events {}\n", []string{"-g", "daemon off;"}, false},
+		{"events {}\n", []string{"-gpid /run/nginx.pid; daemon off;"}, false},
+	}
+	for _, tt := range tests {
+		tr := parseText(t, tt.conf)
+		got, err := isDaemon(tr, tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("isDaemon(%q, %q) = %v, want %v", tt.conf, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPidFile(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "nginx")
+	err := os.WriteFile(bin, []byte(`#!/bin/sh
+echo "nginx version: nginx/1.25.0" >&2
+echo "configure arguments: --prefix=/opt/nginx --pid-path=run/nginx.pid --with-http_ssl_module" >&2
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		conf string
+		args []string
+		want string
+	}{
+		{"pid /run/a.pid;\n", nil, "/run/a.pid"},
+		{"pid a.pid;\n", []string{"-p", "/srv/nginx"}, "/srv/nginx/a.pid"},
+		{"pid a.pid;\n", nil, "/opt/nginx/a.pid"},
+		{"", []string{"-g", "pid /run/b.pid;"}, "/run/b.pid"},
+		{"", nil, "/opt/nginx/run/nginx.pid"},
+		{"", []string{"-p", "/srv/nginx"}, "/srv/nginx/run/nginx.pid"},
+	}
+	for _, tt := range tests {
+		tr := parseText(t, tt.conf)
+		got, err := pidFile(tr, bin, tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("pidFile(%q, %q) = %s, want %s", tt.conf, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestDaemonInstance(t *testing.T) {
+	origInterval := DaemonPollInterval
+	defer func() {
+		DaemonPollInterval = origInterval
+	}()
+	DaemonPollInterval = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "nginx")
+	// forks a master process that writes the PID file, and exits
+	err := os.WriteFile(bin, []byte(`#!/bin/sh
+for arg; do
+	case $arg in
+	-t) exit 0 ;;
+	esac
+	conf=$arg
+done
+pidfile=$(sed -n 's/^pid \(.*\);$/\1/p' "$conf")
+sh -c 'echo $$ > "$1"; exec sleep 60' sh "$pidfile" </dev/null >/dev/null 2>&1 &
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidName := filepath.Join(dir, "nginx.pid")
+	ConfOutDir = t.TempDir()
+	tr := parseText(t, fmt.Sprintf("pid %s;\nevents {}\n", pidName))
+	inst, err := StartInstance(tr, bin, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inst.Daemon() {
+		t.Fatalf("nginx should run as a daemon")
+	}
+	data, err := os.ReadFile(pidName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid, _ := strconv.Atoi(strings.TrimSpace(string(data))); inst.Pid() != pid {
+		t.Errorf("pid = %d, want %d", inst.Pid(), pid)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- inst.Wait()
+	}()
+	err = inst.Signal(syscall.SIGTERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("wait error = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("exiting of the master process should be noticed")
+	}
+}
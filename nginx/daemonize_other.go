@@ -0,0 +1,13 @@
+//go:build !unix
+
+package nginx
+
+import "errors"
+
+func daemonize() error {
+	return errors.New("running nginx as a daemon is not supported on this platform")
+}
+
+func daemonizedReady() func(err error) {
+	return nil
+}
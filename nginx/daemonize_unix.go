@@ -0,0 +1,70 @@
+//go:build unix
+
+package nginx
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonizedEnv is set for the nginxh process started by daemonize.
+const daemonizedEnv = "ACMEHUGGER_DAEMONIZED"
+
+const daemonizedOK = "ok"
+
+// daemonize runs nginxh again in a new session, and returns once the new
+// process reports that nginx has started, like nginx does when it
+// daemonizes.
+func daemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonizedEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if string(msg) == daemonizedOK {
+		return cmd.Process.Release()
+	}
+	// the process has reported the error itself
+	return fmt.Errorf("nginx failed to start: %w", cmd.Wait())
+}
+
+// daemonizedReady returns a function for the process started by daemonize to
+// report whether nginx has started, or nil if nginxh is not daemonized.
+func daemonizedReady() func(err error) {
+	if os.Getenv(daemonizedEnv) == "" {
+		return nil
+	}
+	// don't pass it on to nginx
+	os.Unsetenv(daemonizedEnv)
+	// don't let nginx inherit it, which would keep it open
+	syscall.CloseOnExec(3)
+	f := os.NewFile(3, "ready")
+	return func(err error) {
+		if err == nil {
+			f.WriteString(daemonizedOK)
+		}
+		f.Close()
+	}
+}
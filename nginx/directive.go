@@ -6,13 +6,19 @@ import (
 	"slices"
 	"strconv"
 	"sync"
+
+	"github.com/hgl/acmehugger/internal/set"
 )
 
 type Tree struct {
 	name          string
 	conf          *Config
 	includedConfs map[string]*Config
+	includeGlobs  []string
 	confdir       string
+	skipIncludes  bool
+	srcMap        SourceMap
+	dumpedLines   map[string][]SourceLine
 	mu            sync.Mutex
 }
 
@@ -32,9 +38,18 @@ type Config struct {
 	parent      *IncludeDirective
 	parentBlock *BlockDirective
 	text        string
+	trailing    string
 	lexer       *lexer
 	tr          *Tree
 	out         io.Writer
+	written     bool
+	inComment   bool
+	indentUnit  string
+	lineStarts  []int
+	srcLines    []SourceLine
+	lineStarted bool
+	lineBlank   bool
+	origin      lineOrigin
 }
 
 func (conf *Config) Path() string {
@@ -47,6 +62,16 @@ func (conf *Config) Tree() *Tree {
 	return conf.tr
 }
 
+// Append adds directives to the end of the config. Directives already in a
+// tree are moved, but include directives only within their parent, otherwise
+// it panics.
+func (conf *Config) Append(dires ...Directive) {
+	checkMove(conf, dires)
+	detach(nil, dires)
+	conf.Children = append(conf.Children, dires...)
+	adopt(conf, dires)
+}
+
 type Directive interface {
 	Name() string
 	Args() []string
@@ -54,17 +79,44 @@ type Directive interface {
 	Parent() any
 	ParentBlock() *BlockDirective
 	Location() string
+	// ReplaceWith, InsertBefore and InsertAfter move directives already in
+	// a tree. Include directives can only be moved within their parent,
+	// otherwise they panic, leaving the tree intact.
 	ReplaceWith(...Directive)
+	InsertBefore(...Directive)
+	InsertAfter(...Directive)
 	Delete()
 	Config() *Config
 	Tree() *Tree
 	position() pos
+	layoutInfo() *layout
 	setParent(any)
 	setParentBlock(*BlockDirective)
 }
 
+// layout records how a parsed directive is laid out in its config, so that
+// it can be dumped exactly as written if it's not modified.
+type layout struct {
+	// space holds the white spaces and comments preceding the directive.
+	space string
+	// trail holds what follows the directive on the same line, usually a
+	// comment.
+	trail string
+	// end is the position right after the directive's ";" or "{".
+	end   pos
+	dirty bool
+	// moved is true if the directive has been moved to another depth, so
+	// the indentation in space is stale.
+	moved bool
+}
+
+func (l *layout) layoutInfo() *layout {
+	return l
+}
+
 type SimpleDirective struct {
 	pos
+	layout
 	name        string
 	args        []string
 	raw         []string
@@ -82,6 +134,7 @@ func (d *SimpleDirective) Args() []string {
 func (d *SimpleDirective) SetArg(i int, s string) {
 	d.args[i] = s
 	d.raw[i+1] = escape(s)
+	d.dirty = true
 }
 func (d *SimpleDirective) BoolArg() (on bool, err error) {
 	if len(d.args) == 1 {
@@ -140,6 +193,12 @@ func (d *SimpleDirective) ParentBlock() *BlockDirective {
 func (d *SimpleDirective) ReplaceWith(dires ...Directive) {
 	replaceDire(d.parent, d, dires...)
 }
+func (d *SimpleDirective) InsertBefore(dires ...Directive) {
+	insertDire(d.parent, d, 0, dires...)
+}
+func (d *SimpleDirective) InsertAfter(dires ...Directive) {
+	insertDire(d.parent, d, 1, dires...)
+}
 func (d *SimpleDirective) Delete() {
 	deleteDire(d.parent, d)
 }
@@ -161,6 +220,7 @@ func (d *SimpleDirective) setParentBlock(b *BlockDirective) {
 
 type BlockDirective struct {
 	pos
+	layout
 	name        string
 	args        []string
 	raw         []string
@@ -168,6 +228,11 @@ type BlockDirective struct {
 	conf        *Config
 	parent      any
 	parentBlock *BlockDirective
+	// openTrail holds what follows "{" on the same line.
+	openTrail string
+	// closeSpace holds the white spaces and comments preceding "}".
+	closeSpace string
+	closePos   pos
 }
 
 func (d *BlockDirective) Name() string {
@@ -185,6 +250,12 @@ func (d *BlockDirective) ParentBlock() *BlockDirective {
 func (d *BlockDirective) ReplaceWith(dires ...Directive) {
 	replaceDire(d.parent, d, dires...)
 }
+func (d *BlockDirective) InsertBefore(dires ...Directive) {
+	insertDire(d.parent, d, 0, dires...)
+}
+func (d *BlockDirective) InsertAfter(dires ...Directive) {
+	insertDire(d.parent, d, 1, dires...)
+}
 func (d *BlockDirective) Delete() {
 	deleteDire(d.parent, d)
 }
@@ -197,6 +268,26 @@ func (d *BlockDirective) Config() *Config {
 func (d *BlockDirective) Tree() *Tree {
 	return d.conf.tr
 }
+
+// Append adds directives to the end of the block. Directives already in a
+// tree are moved, but include directives only within their parent, otherwise
+// it panics.
+func (d *BlockDirective) Append(dires ...Directive) {
+	checkMove(d, dires)
+	detach(nil, dires)
+	d.Children = append(d.Children, dires...)
+	adopt(d, dires)
+}
+
+// Prepend adds directives to the start of the block. Directives already in a
+// tree are moved, but include directives only within their parent, otherwise
+// it panics.
+func (d *BlockDirective) Prepend(dires ...Directive) {
+	checkMove(d, dires)
+	detach(nil, dires)
+	d.Children = slices.Insert(d.Children, 0, dires...)
+	adopt(d, dires)
+}
 func (d *BlockDirective) setParent(parent any) {
 	d.parent = parent
 }
@@ -204,8 +295,109 @@ func (d *BlockDirective) setParentBlock(b *BlockDirective) {
 	d.parentBlock = b
 }
 
+// RawBlockDirective is a block whose content isn't made of directives, e.g.,
+// Lua code in content_by_lua_block { ... }. Its content is kept as is.
+type RawBlockDirective struct {
+	pos
+	layout
+	name        string
+	args        []string
+	raw         []string
+	Body        string
+	conf        *Config
+	parent      any
+	parentBlock *BlockDirective
+}
+
+func (d *RawBlockDirective) Name() string {
+	return d.name
+}
+func (d *RawBlockDirective) Args() []string {
+	return d.args
+}
+func (d *RawBlockDirective) SetBody(body string) {
+	d.Body = body
+	d.dirty = true
+}
+func (d *RawBlockDirective) Parent() any {
+	return d.parent
+}
+func (d *RawBlockDirective) ParentBlock() *BlockDirective {
+	return d.parentBlock
+}
+func (d *RawBlockDirective) ReplaceWith(dires ...Directive) {
+	replaceDire(d.parent, d, dires...)
+}
+func (d *RawBlockDirective) InsertBefore(dires ...Directive) {
+	insertDire(d.parent, d, 0, dires...)
+}
+func (d *RawBlockDirective) InsertAfter(dires ...Directive) {
+	insertDire(d.parent, d, 1, dires...)
+}
+func (d *RawBlockDirective) Delete() {
+	deleteDire(d.parent, d)
+}
+func (d *RawBlockDirective) Location() string {
+	return loc(d)
+}
+func (d *RawBlockDirective) Config() *Config {
+	return d.conf
+}
+func (d *RawBlockDirective) Tree() *Tree {
+	return d.conf.tr
+}
+func (d *RawBlockDirective) setParent(parent any) {
+	d.parent = parent
+}
+func (d *RawBlockDirective) setParentBlock(b *BlockDirective) {
+	d.parentBlock = b
+}
+
+// rawBlocks are blocks whose content is not in nginx's syntax. njs needs
+// none, since its code lives in files imported by js_import, and the entries
+// of blocks like map, geo and types are parsed by nginx as directives too.
+var rawBlocks = set.NewSet(
+	"init_by_lua_block",
+	"init_worker_by_lua_block",
+	"exit_worker_by_lua_block",
+	"set_by_lua_block",
+	"server_rewrite_by_lua_block",
+	"rewrite_by_lua_block",
+	"access_by_lua_block",
+	"content_by_lua_block",
+	"header_filter_by_lua_block",
+	"body_filter_by_lua_block",
+	"log_by_lua_block",
+	"balancer_by_lua_block",
+	"preread_by_lua_block",
+	"ssl_client_hello_by_lua_block",
+	"ssl_certificate_by_lua_block",
+	"ssl_session_fetch_by_lua_block",
+	"ssl_session_store_by_lua_block",
+)
+var rawBlocksMu sync.RWMutex
+
+// RegisterRawBlock makes blocks of the given directive names parsed as
+// RawBlockDirective. OpenResty's *_by_lua_block directives are registered by
+// default.
+func RegisterRawBlock(names ...string) {
+	rawBlocksMu.Lock()
+	defer rawBlocksMu.Unlock()
+	for _, name := range names {
+		rawBlocks.Add(name)
+	}
+}
+
+func isRawBlock(name string) bool {
+	rawBlocksMu.RLock()
+	defer rawBlocksMu.RUnlock()
+	_, ok := rawBlocks[name]
+	return ok
+}
+
 type IncludeDirective struct {
 	pos
+	layout
 	Target      string
 	Includes    []*Config
 	conf        *Config
@@ -228,6 +420,12 @@ func (d *IncludeDirective) ParentBlock() *BlockDirective {
 func (d *IncludeDirective) ReplaceWith(dires ...Directive) {
 	replaceDire(d.parent, d, dires...)
 }
+func (d *IncludeDirective) InsertBefore(dires ...Directive) {
+	insertDire(d.parent, d, 0, dires...)
+}
+func (d *IncludeDirective) InsertAfter(dires ...Directive) {
+	insertDire(d.parent, d, 1, dires...)
+}
 func (d *IncludeDirective) Delete() {
 	deleteDire(d.parent, d)
 }
@@ -251,6 +449,19 @@ type DeferredDirective struct {
 	Directive
 }
 
+func (d *DeferredDirective) ReplaceWith(dires ...Directive) {
+	replaceDire(d.Parent(), d, dires...)
+}
+func (d *DeferredDirective) InsertBefore(dires ...Directive) {
+	insertDire(d.Parent(), d, 0, dires...)
+}
+func (d *DeferredDirective) InsertAfter(dires ...Directive) {
+	insertDire(d.Parent(), d, 1, dires...)
+}
+func (d *DeferredDirective) Delete() {
+	deleteDire(d.Parent(), d)
+}
+
 func (d *DeferredDirective) Undefer() {
 	replaceDire(d.Parent(), d, d.Directive)
 }
@@ -261,10 +472,12 @@ func newDeferredDirective(dire Directive) *DeferredDirective {
 		d.name = d.args[0]
 		d.args = d.args[1:]
 		d.raw = d.raw[1:]
+		d.dirty = true
 	case *BlockDirective:
 		d.name = d.args[0]
 		d.args = d.args[1:]
 		d.raw = d.raw[1:]
+		d.dirty = true
 	default:
 		panic("directive cannot be deferred")
 	}
@@ -309,6 +522,21 @@ func NewBlockDirective(name string, args []string, block ...Directive) *BlockDir
 	}
 }
 
+func NewRawBlockDirective(name string, args []string, body string) *RawBlockDirective {
+	raw := make([]string, len(args)+1)
+	raw[0] = escape(name)
+	for i := 0; i < len(args); i++ {
+		raw[i+1] = escape(args[i])
+	}
+	return &RawBlockDirective{
+		pos:  -1,
+		name: name,
+		args: args,
+		raw:  raw,
+		Body: body,
+	}
+}
+
 func loc(d Directive) string {
 	filename := d.Config().path
 	text := d.Config().text
@@ -316,28 +544,140 @@ func loc(d Directive) string {
 	return fmt.Sprintf("%s:%s", filename, loc)
 }
 
-func replaceDire(parent any, target Directive, replacement ...Directive) {
-	var children *[]Directive
+func childrenOf(parent any) *[]Directive {
 	switch p := parent.(type) {
 	case *BlockDirective:
-		children = &p.Children
+		return &p.Children
 	case *Config:
-		children = &p.Children
+		return &p.Children
+	default:
+		panic("directive is not in a tree")
 	}
+}
+
+func replaceDire(parent any, target Directive, replacement ...Directive) {
+	checkMove(parent, replacement)
+	detach(target, replacement)
+	children := childrenOf(parent)
 	i := slices.Index(*children, target)
 	if i != -1 {
 		*children = slices.Replace(*children, i, i+1, replacement...)
+		adopt(parent, replacement)
 	}
 }
 
-func deleteDire(parent any, target Directive) {
-	var children *[]Directive
+// insertDire inserts directives before target if offset is 0, or after it if
+// offset is 1.
+func insertDire(parent any, target Directive, offset int, dires ...Directive) {
+	checkMove(parent, dires)
+	detach(target, dires)
+	children := childrenOf(parent)
+	i := slices.Index(*children, target)
+	if i != -1 {
+		*children = slices.Insert(*children, i+offset, dires...)
+		adopt(parent, dires)
+	}
+}
+
+// checkMove panics if directives include an include directive that would be
+// moved out of its parent, which the configs it includes can't follow.
+func checkMove(parent any, dires []Directive) {
+	for _, dire := range dires {
+		if dd, ok := dire.(*DeferredDirective); ok {
+			dire = dd.Directive
+		}
+		if _, ok := dire.(*IncludeDirective); ok && dire.Parent() != parent {
+			panic("include directive cannot be moved to another parent: " + dire.Location())
+		}
+	}
+}
+
+// detach removes directives from the trees they are in, except for keep, so
+// that they can be moved.
+func detach(keep Directive, dires []Directive) {
+	for _, d := range dires {
+		if d == keep || d.Parent() == nil {
+			continue
+		}
+		deleteDire(d.Parent(), d)
+	}
+}
+
+// adopt makes directives consistent with their new parent, including those
+// nested in them that are not yet in a tree.
+func adopt(parent any, dires []Directive) {
+	var conf *Config
+	var parentBlock *BlockDirective
 	switch p := parent.(type) {
 	case *BlockDirective:
-		children = &p.Children
+		conf = p.conf
+		parentBlock = p
 	case *Config:
-		children = &p.Children
+		conf = p
+		parentBlock = p.parentBlock
 	}
+	for _, dire := range dires {
+		if dd, ok := dire.(*DeferredDirective); ok {
+			dire = dd.Directive
+		}
+		if _, ok := dire.(*IncludeDirective); ok {
+			// checked by checkMove to be in the parent already
+			continue
+		}
+		if dire.position() != -1 && dire.Parent() != nil && depth(dire.Parent()) != depth(parent) {
+			setMoved(dire)
+		}
+		dire.setParent(parent)
+		dire.setParentBlock(parentBlock)
+		switch d := dire.(type) {
+		case *SimpleDirective:
+			if d.conf == nil {
+				d.conf = conf
+			}
+		case *RawBlockDirective:
+			if d.conf == nil {
+				d.conf = conf
+			}
+		case *BlockDirective:
+			if d.conf == nil {
+				d.conf = conf
+			}
+			adopt(d, d.Children)
+		}
+	}
+}
+
+// depth returns how many blocks the parent is nested in within its config.
+func depth(parent any) int {
+	n := 0
+	for {
+		b, ok := parent.(*BlockDirective)
+		if !ok {
+			return n
+		}
+		n++
+		parent = b.parent
+	}
+}
+
+// setMoved marks the parsed directive and those nested in it as moved to
+// another depth.
+func setMoved(dire Directive) {
+	if dd, ok := dire.(*DeferredDirective); ok {
+		dire = dd.Directive
+	}
+	dire.layoutInfo().moved = true
+	if b, ok := dire.(*BlockDirective); ok {
+		for _, child := range b.Children {
+			if child.position() != -1 {
+				setMoved(child)
+			}
+		}
+	}
+}
+
+func deleteDire(parent any, target Directive) {
+	children := childrenOf(parent)
 	i := slices.Index(*children, target)
 	if i != -1 {
 		*children = slices.Delete(*children, i, i+1)
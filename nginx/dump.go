@@ -14,9 +14,12 @@ import (
 func (tr *Tree) Dump(outdir string) (name string, err error) {
 	defer func() {
 		if err == nil {
+			tr.srcMap.add(tr.dumpedLines)
 			slog.Debug("config dumped", "path", name)
 		}
+		tr.dumpedLines = nil
 	}()
+	tr.dumpedLines = make(map[string][]SourceLine)
 	return tr.conf.dump(outdir)
 }
 
@@ -39,17 +42,34 @@ func (conf *Config) dump(outdir string) (name string, err error) {
 		}
 	}()
 	conf.out = f
+	conf.written = false
+	conf.inComment = false
+	conf.srcLines = nil
+	conf.lineStarted = false
+	conf.origin = lineOrigin{conf: conf, pos: -1, synthesized: true}
+	conf.indentUnit = indentUnit(conf.Children, "")
+	if conf.indentUnit == "" {
+		conf.indentUnit = "\t"
+	}
+	indent := childIndent(conf.Children, "")
 	for _, d := range conf.Children {
-		conf.dumpDirective(d, 0, outdir)
+		conf.dumpDirective(d, indent, outdir)
 	}
+	conf.emit(conf.trailing, conf.sourceAt(len(conf.text)-len(conf.trailing)))
+	conf.tr.dumpedLines[name] = conf.srcLines
 	return name, nil
 }
 
 func (conf *Config) write(s string) {
+	if s == "" {
+		return
+	}
 	_, err := io.WriteString(conf.out, s)
 	if err != nil {
 		panic(err)
 	}
+	conf.written = true
+	conf.inComment = false
 }
 
 func (conf *Config) recover(errp *error) {
@@ -64,69 +84,208 @@ func (conf *Config) recover(errp *error) {
 	}
 }
 
-func (conf *Config) dumpDirective(dire Directive, depth int, outdir string) {
+// dumpDirective writes the directive as it was written in its config, unless
+// it's generated or modified, in which case it's written on a new line with
+// the given indentation.
+func (conf *Config) dumpDirective(dire Directive, indent string, outdir string) {
+	if _, ok := dire.(*DeferredDirective); ok {
+		return
+	}
+	l := dire.layoutInfo()
+	p := dire.position()
+	if p == -1 {
+		if conf.written {
+			conf.emit("\n", conf.origin)
+		}
+		conf.emit(indent, conf.origin)
+	} else {
+		space := l.space
+		if l.moved {
+			space = reindent(space, indent)
+		}
+		if !conf.breakComment(space, indent) {
+			conf.emit(space, dire.Config().sourceAt(int(p)-len(l.space)))
+		}
+		indent = spaceIndent(space, indent)
+	}
+	// Modified directives are regenerated, but still originate from the
+	// parsed ones.
+	regen := conf.origin
+	if p != -1 {
+		regen = lineOrigin{conf: dire.Config(), pos: p, fixed: true}
+	}
+	trailPos := int(l.end)
 	switch d := dire.(type) {
 	case *SimpleDirective:
-		for i := 0; i < depth; i++ {
-			conf.write("\t")
+		if d.pristine() {
+			conf.emit(d.conf.text[d.pos:d.end], d.conf.sourceAt(int(d.pos)))
+		} else {
+			conf.emit(strings.Join(d.raw, " ")+";", regen)
 		}
-		for i, arg := range d.raw {
-			if i != 0 {
-				conf.write(" ")
-			}
-			conf.write(arg)
+	case *RawBlockDirective:
+		if d.pristine() {
+			conf.emit(d.conf.text[d.pos:d.end], d.conf.sourceAt(int(d.pos)))
+		} else {
+			conf.emit(strings.Join(d.raw, " ")+" {"+d.Body+"}", regen)
 		}
-		conf.write(";\n")
-		return
 	case *IncludeDirective:
-		for i := 0; i < depth; i++ {
-			conf.write("\t")
-		}
-		conf.write(d.Name())
-		conf.write(" ")
 		target := d.Target
 		if !filepath.IsAbs(d.Target) {
 			target = filepath.Join(d.conf.tr.confdir, target)
 		}
 		target = filepath.Join(outdir, target)
-		conf.write(escape(target))
-		conf.write(";\n")
+		conf.emit(d.Name()+" "+escape(target)+";", regen)
 		for _, sub := range d.Includes {
 			_, err := sub.dump(outdir)
 			if err != nil {
 				panic(err)
 			}
 		}
-		return
 	case *BlockDirective:
-		for i := 0; i < depth; i++ {
-			conf.write("\t")
+		if d.pristine() {
+			conf.emit(d.conf.text[d.pos:d.end], d.conf.sourceAt(int(d.pos)))
+		} else {
+			conf.emit(strings.Join(d.raw, " ")+" {", regen)
 		}
-		for i, arg := range d.raw {
-			if i != 0 {
-				conf.write(" ")
-			}
-			conf.write(arg)
+		origin := conf.origin
+		if d.pos != -1 {
+			conf.emitTrail(d.openTrail, d.conf.sourceAt(int(d.end)))
+			conf.origin = lineOrigin{conf: d.conf, pos: d.pos, synthesized: true}
 		}
-		conf.write(" {")
-		if len(d.Children) == 0 {
-			conf.write("}\n")
-		} else {
-			conf.write("\n")
-			for _, child := range d.Children {
-				conf.dumpDirective(child, depth+1, outdir)
+		cindent := childIndent(d.Children, indent+conf.indentUnit)
+		for _, child := range d.Children {
+			conf.dumpDirective(child, cindent, outdir)
+		}
+		n := len(d.Children)
+		switch {
+		case d.pos != -1 && (n == 0 || d.Children[n-1].position() != -1 ||
+			strings.Contains(d.closeSpace, "\n")):
+			closeSpace := d.closeSpace
+			if d.moved {
+				closeSpace = reindent(closeSpace, indent)
 			}
-			for i := 0; i <= depth-1; i++ {
-				conf.write("\t")
+			if !conf.breakComment(closeSpace, indent) {
+				conf.emit(closeSpace, d.conf.sourceAt(int(d.closePos)-len(d.closeSpace)))
 			}
-			conf.write("}\n")
+		case n != 0:
+			conf.emit("\n"+indent, conf.origin)
 		}
-		return
-	case *DeferredDirective:
-		return
+		conf.origin = origin
+		if d.pos != -1 {
+			conf.emit("}", d.conf.sourceAt(int(d.closePos)))
+		} else {
+			conf.emit("}", conf.origin)
+		}
+		trailPos = int(d.closePos) + 1
 	default:
 		panic("unknown Directive")
 	}
+	if p != -1 {
+		conf.emitTrail(l.trail, dire.Config().sourceAt(trailPos))
+	}
+}
+
+// emitTrail is like emit, but for text that ends a line, which might be a
+// comment.
+func (conf *Config) emitTrail(s string, o lineOrigin) {
+	conf.emit(s, o)
+	conf.inComment = strings.Contains(s, "#")
+}
+
+// breakComment starts a new line if the last line ends with a comment and
+// space doesn't start a new line, which happens when directives are moved
+// around. It reports whether it did so, in which case space, which is then
+// the blanks between directives on a line, is not needed.
+func (conf *Config) breakComment(space string, indent string) bool {
+	if conf.inComment && !strings.Contains(space, "\n") {
+		conf.emit("\n"+indent, conf.origin)
+		return true
+	}
+	return false
+}
+
+func (conf *Config) sourceAt(p int) lineOrigin {
+	return lineOrigin{conf: conf, pos: pos(p)}
+}
+
+func (d *SimpleDirective) pristine() bool {
+	return d.pos != -1 && !d.dirty && d.conf != nil
+}
+
+func (d *RawBlockDirective) pristine() bool {
+	return d.pos != -1 && !d.dirty && d.conf != nil
+}
+
+func (d *BlockDirective) pristine() bool {
+	return d.pos != -1 && !d.dirty && d.conf != nil
+}
+
+// spaceIndent returns the indentation at the end of space, or def if space
+// doesn't end with one.
+func spaceIndent(space string, def string) string {
+	i := strings.LastIndexByte(space, '\n')
+	if i == -1 {
+		return def
+	}
+	indent := space[i+1:]
+	if strings.TrimSpace(indent) != "" {
+		return def
+	}
+	return indent
+}
+
+// reindent replaces the indentation of the lines in space after the first
+// one with indent, leaving blank lines empty.
+func reindent(space string, indent string) string {
+	lines := strings.Split(space, "\n")
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimLeftFunc(lines[i], unicode.IsSpace)
+		if line != "" || i == len(lines)-1 {
+			line = indent + line
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// indentUnit returns the indentation added by the first parsed block that
+// has parsed children, or an empty string if there is none.
+func indentUnit(children []Directive, indent string) string {
+	for _, d := range children {
+		b, ok := d.(*BlockDirective)
+		if !ok || b.pos == -1 {
+			continue
+		}
+		bindent := spaceIndent(b.space, indent)
+		cindent := childIndent(b.Children, bindent)
+		if len(cindent) > len(bindent) && strings.HasPrefix(cindent, bindent) {
+			return cindent[len(bindent):]
+		}
+		unit := indentUnit(b.Children, cindent)
+		if unit != "" {
+			return unit
+		}
+	}
+	return ""
+}
+
+// childIndent returns the indentation used by the parsed children, or def if
+// there is none.
+func childIndent(children []Directive, def string) string {
+	for _, d := range children {
+		if d.position() == -1 || d.layoutInfo().moved {
+			continue
+		}
+		if _, ok := d.(*DeferredDirective); ok {
+			continue
+		}
+		const none = "\x00"
+		indent := spaceIndent(d.layoutInfo().space, none)
+		if indent != none {
+			return indent
+		}
+	}
+	return def
 }
 
 func escape(v string) string {
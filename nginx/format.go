@@ -0,0 +1,147 @@
+package nginx
+
+import (
+	"strings"
+)
+
+// FormatIndent is the indentation of each level in formatted configs.
+const FormatIndent = "\t"
+
+// Format formats the config text in the canonical style: one directive per
+// line, indented by FormatIndent, with at most one blank line between
+// directives, and values quoted only when needed. Comments are kept, and
+// included configs are left alone. name is only used in error messages.
+func Format(name string, text string) (string, error) {
+	conf, children, err := parseSnippet(name, text)
+	if err != nil {
+		return "", err
+	}
+	f := &formatter{}
+	f.directives(children)
+	f.space(conf.trailing, false)
+	return f.b.String(), nil
+}
+
+// parseSnippet parses the config text without following includes.
+func parseSnippet(name string, text string) (*Config, []Directive, error) {
+	tr := &Tree{name: name, skipIncludes: true}
+	conf := &Config{
+		path:  name,
+		text:  text,
+		lexer: newLexer(text),
+		tr:    tr,
+	}
+	children, err := conf.parseDirectives()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conf, children, nil
+}
+
+type formatter struct {
+	b     strings.Builder
+	level int
+	// atStart is true if nothing has been written at the current level,
+	// where blank lines are dropped.
+	atStart bool
+}
+
+func (f *formatter) line(s string) {
+	f.b.WriteString(strings.Repeat(FormatIndent, f.level))
+	f.b.WriteString(s)
+	f.b.WriteByte('\n')
+	f.atStart = false
+}
+
+// space writes the comments in space on their own lines. Blank lines are
+// kept between comments and directives, but squeezed into one. If
+// beforeDirective is false, blank lines at the end are dropped.
+func (f *formatter) space(space string, beforeDirective bool) {
+	segs := strings.Split(space, "\n")
+	blank := false
+	for i, seg := range segs {
+		// stray semicolons are dropped
+		seg = strings.TrimLeft(seg, " \t\r;")
+		seg = strings.TrimRight(seg, " \t\r")
+		if seg == "" {
+			if i != 0 && i != len(segs)-1 {
+				blank = true
+			}
+			continue
+		}
+		if blank && !f.atStart {
+			f.b.WriteByte('\n')
+		}
+		blank = false
+		f.line(seg)
+	}
+	if blank && beforeDirective && !f.atStart {
+		f.b.WriteByte('\n')
+	}
+}
+
+func (f *formatter) directives(children []Directive) {
+	f.atStart = true
+	for _, d := range children {
+		l := d.layoutInfo()
+		f.space(l.space, true)
+		switch d := d.(type) {
+		case *SimpleDirective:
+			f.line(formatHead(d.conf, d.pos, d.end, d.raw, d.args) + ";" + formatTrail(l.trail))
+		case *RawBlockDirective:
+			f.line(formatHead(d.conf, d.pos, -1, d.raw, d.args) + " {" + d.Body + "}" + formatTrail(l.trail))
+		case *BlockDirective:
+			head := formatHead(d.conf, d.pos, d.end, d.raw, d.args)
+			if len(d.Children) == 0 && strings.TrimSpace(d.openTrail) == "" &&
+				!strings.Contains(d.closeSpace, "#") {
+				f.line(head + " {}" + formatTrail(l.trail))
+				continue
+			}
+			f.line(head + " {" + formatTrail(d.openTrail))
+			f.level++
+			f.directives(d.Children)
+			f.space(d.closeSpace, false)
+			f.level--
+			f.line("}" + formatTrail(l.trail))
+		default:
+			panic("unknown Directive")
+		}
+	}
+}
+
+// formatHead formats the name and values of the directive ending at end. If
+// comments are among the values, they are written as is.
+func formatHead(conf *Config, start pos, end pos, raw []string, args []string) string {
+	if end != -1 {
+		src := conf.text[start : end-1]
+		if strings.Contains(src, "#") && strings.Contains(src, "\n") {
+			return strings.TrimRight(src, " \t\r\n")
+		}
+	}
+	parts := make([]string, len(raw))
+	parts[0] = raw[0]
+	for i, arg := range args {
+		parts[i+1] = formatArg(raw[i+1], arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatTrail(trail string) string {
+	trail = strings.TrimSpace(trail)
+	if trail == "" {
+		return ""
+	}
+	return " " + trail
+}
+
+// formatArg unquotes the value if it reads the same without quotes, both to
+// nginx and to the lexer. Otherwise it's written as is.
+func formatArg(raw string, value string) string {
+	if raw == "" || (raw[0] != '"' && raw[0] != '\'') {
+		return raw
+	}
+	if escape(value) != value || strings.ContainsAny(value, "\\}#\"'") {
+		return raw
+	}
+	return value
+}
@@ -0,0 +1,87 @@
+package nginx
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+func TestFormat(t *testing.T) {
+	names, err := filepath.Glob("testdata/format/*.in.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range names {
+		text, err := util.ReadText(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := util.ReadText(strings.TrimSuffix(src, ".in.conf") + ".out.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Format(src, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s formatted\n%s\nwant\n%s", src, got, want)
+		}
+		again, err := Format(src, got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != got {
+			t.Errorf("%s is not formatted idempotently:\n%s", src, again)
+		}
+	}
+}
+
+func TestFmt(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "nginx.conf")
+	err := os.WriteFile(name, []byte("events {}\nhttp {\n    include a/*.conf;\n}\n"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = Fmt([]string{"-d", name}, nil, &out)
+	if !errors.Is(err, ErrNotFormatted) {
+		t.Errorf("got error %v, want ErrNotFormatted", err)
+	}
+	want := "--- " + name + "\n+++ " + name + ` (formatted)
+@@ -1,4 +1,4 @@
+ events {}
+ http {
+-    include a/*.conf;
++	include a/*.conf;
+ }
+`
+	if out.String() != want {
+		t.Errorf("diff\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	err = Fmt([]string{"-w", name}, nil, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("-w should not write to stdout")
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("-w should keep the file mode")
+	}
+	err = Fmt([]string{"-d", name}, nil, &out)
+	if err != nil || out.Len() != 0 {
+		t.Errorf("formatted file should have no diff, got %v:\n%s", err, out.String())
+	}
+}
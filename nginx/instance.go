@@ -1,42 +1,179 @@
 package nginx
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
 )
 
-type Instance exec.Cmd
+type Instance struct {
+	proc     process
+	bin      string
+	args     []string
+	tr       *Tree
+	versions *ConfVersions
+	// daemon is true if nginx runs as a daemon, rather than as a child
+	daemon bool
+	// sidecar is true if nginx is not started by nginxh
+	sidecar bool
+	// reloadErr is the error of the last reload.
+	reloadErr error
+	metrics   *Metrics
+	mu        sync.Mutex
+}
+
+// process is the nginx master process.
+type process interface {
+	Pid() int
+	Signal(sig os.Signal) error
+	Wait() error
+}
+
+type childProcess struct {
+	cmd *exec.Cmd
+}
 
-func StartInstance(tr *Tree, bin string, args []string) (*Instance, error) {
-	name, err := tr.Dump(ConfOutDir)
+func (p *childProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *childProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *childProcess) Wait() error {
+	err := p.cmd.Wait()
+	flushStderr(p.cmd)
+	return err
+}
+
+// StartInstance starts nginx with the tree dumped. If nginx runs as a
+// daemon, its master process is found from the PID file. Reloads are
+// recorded in m if it's not nil.
+func StartInstance(tr *Tree, bin string, args []string, m *Metrics) (*Instance, error) {
+	daemon, err := isDaemon(tr, args)
+	if err != nil {
+		return nil, err
+	}
+	var pidName string
+	if daemon {
+		pidName, err = pidFile(tr, bin, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	versions := NewConfVersions(ConfOutDir, ConfKeepVersions)
+	name, err := versions.Dump(tr)
 	if err != nil {
 		return nil, err
 	}
 
-	args = append([]string{}, args...)
-	args = append(args, "-c", name)
-	cmd := exec.Command(bin, args...)
+	cmd := command(tr, bin, args, name)
+	var proc process
+	if daemon {
+		proc, err = startDaemon(cmd, pidName)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = cmd.Start()
+		if err != nil {
+			return nil, err
+		}
+		proc = &childProcess{cmd}
+	}
+	slog.Debug("nginx started", "pid", proc.Pid(), "daemon", daemon, "bin", bin, "args", cmd.Args[1:])
+	return &Instance{
+		proc:     proc,
+		bin:      bin,
+		args:     args,
+		tr:       tr,
+		versions: versions,
+		daemon:   daemon,
+		metrics:  m,
+	}, nil
+}
+
+func command(tr *Tree, bin string, args []string, name string) *exec.Cmd {
+	cmd := exec.Command(bin, append(slices.Clone(args), "-c", name)...)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Start()
+	cmd.Stderr = tr.SourceMap().Writer(os.Stderr)
+	return cmd
+}
+
+// flushStderr writes the last line nginx printed to stderr after it has
+// exited, if the line doesn't end with a newline.
+func flushStderr(cmd *exec.Cmd) {
+	if w, ok := cmd.Stderr.(io.Closer); ok {
+		w.Close()
+	}
+}
+
+// Restart starts nginx again with the current config after it has exited.
+// It's only for nginx running as a child.
+func (inst *Instance) Restart() error {
+	if inst.daemon || inst.sidecar {
+		return errors.New("only nginx started as a child can be restarted")
+	}
+	cmd := command(inst.tr, inst.bin, inst.args, inst.versions.CurrentConf(inst.tr))
+	err := cmd.Start()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	slog.Debug("nginx started", "pid", cmd.Process.Pid, "bin", bin, "args", args)
-	return (*Instance)(cmd), nil
+	inst.proc = &childProcess{cmd}
+	slog.Debug("nginx restarted", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// ConfigTestError is returned when nginx rejects a generated config. Output
+// is nginx's output, with locations pointing to the original configs.
+type ConfigTestError struct {
+	Output string
+}
+
+func (e *ConfigTestError) Error() string {
+	return "nginx rejected the generated config: " + e.Output
 }
 
-func (inst *Instance) Reload(tr *Tree) error {
-	// TODO: throttle reloading and generate config in different folder and symlink to assure being atomic
+// Reload makes nginx reload its config. If tr is not nil, it's dumped as a
+// new config version first. The config is tested with "nginx -t" before
+// nginx is signaled, and if the test fails, the previous config version
+// stays current and a *ConfigTestError is returned.
+func (inst *Instance) Reload(tr *Tree) (err error) {
+	defer func() {
+		inst.mu.Lock()
+		inst.reloadErr = err
+		inst.mu.Unlock()
+		inst.metrics.reloaded(err)
+	}()
 	if tr != nil {
-		_, err := tr.Dump(ConfOutDir)
+		n, name, err := inst.versions.Prepare(tr)
+		if err != nil {
+			return err
+		}
+		err = inst.test(name)
+		if err != nil {
+			inst.versions.Discard(tr, n)
+			return err
+		}
+		err = inst.versions.Activate(tr, n)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := inst.test(inst.versions.CurrentConf(inst.tr))
 		if err != nil {
 			return err
 		}
 	}
-	err := (*exec.Cmd)(inst).Process.Signal(syscall.SIGHUP)
+	err = inst.proc.Signal(syscall.SIGHUP)
 	if err != nil {
 		return err
 	}
@@ -44,12 +181,86 @@ func (inst *Instance) Reload(tr *Tree) error {
 	return nil
 }
 
+// Rollback makes the config version before the current one current again,
+// and makes nginx reload it. It's for when nginx fails to apply a config
+// that passed "nginx -t", e.g., because a port can't be bound.
+func (inst *Instance) Rollback() error {
+	err := inst.versions.Rollback(inst.tr)
+	if err != nil {
+		return err
+	}
+	return inst.Reload(nil)
+}
+
+// ReloadError returns the error of the last reload, or nil if it succeeded.
+func (inst *Instance) ReloadError() error {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.reloadErr
+}
+
+// test runs "nginx -t" with the config name.
+func (inst *Instance) test(name string) error {
+	if inst.sidecar {
+		// nginx may only be available in another container
+		if _, err := exec.LookPath(inst.bin); err != nil {
+			slog.Debug("config test skipped, nginx not found", "bin", inst.bin)
+			return nil
+		}
+	}
+	cmd := exec.Command(inst.bin, append(slices.Clone(inst.args), "-t", "-c", name)...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ConfigTestError{Output: strings.TrimSpace(inst.tr.SourceMap().Rewrite(out.String()))}
+	}
+	if err != nil {
+		return err
+	}
+	slog.Debug("config tested", "name", name)
+	return nil
+}
+
+// Pid returns the PID of the nginx master process.
+func (inst *Instance) Pid() int {
+	return inst.proc.Pid()
+}
+
+// Daemon reports whether nginx runs as a daemon.
+func (inst *Instance) Daemon() bool {
+	return inst.daemon
+}
+
+// Sidecar reports whether nginx is not started by nginxh.
+func (inst *Instance) Sidecar() bool {
+	return inst.sidecar
+}
+
+func (inst *Instance) Signal(sig os.Signal) error {
+	return inst.proc.Signal(sig)
+}
+
+func (inst *Instance) Kill() error {
+	return inst.proc.Signal(os.Kill)
+}
+
+// Wait waits for nginx to exit. For a daemonized nginx, the error is always
+// nil, since its exit status is unknown.
 func (inst *Instance) Wait() error {
-	return (*exec.Cmd)(inst).Wait()
+	return inst.proc.Wait()
 }
 
+// ExitCode returns the exit code for err. A process killed by a signal
+// results in 128 plus the signal number, like in shells.
 func ExitCode(err error) int {
-	if e, ok := err.(*exec.ExitError); ok {
+	var e *exec.ExitError
+	if errors.As(err, &e) {
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
 		return e.ExitCode()
 	}
 	if err != nil {
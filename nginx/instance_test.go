@@ -0,0 +1,106 @@
+package nginx
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeNginx is a stand-in for nginx. With -t, it rejects configs containing
+// the bad_directive directive, otherwise it runs until killed.
+const fakeNginx = `#!/bin/sh
+test=
+while [ $# -gt 0 ]; do
+	case $1 in
+	-t) test=1 ;;
+	-c) conf=$2; shift ;;
+	esac
+	shift
+done
+if [ -z "$test" ]; then
+	exec sleep 60
+fi
+line=$(grep -n bad_directive "$conf" | cut -d: -f1)
+if [ -n "$line" ]; then
+	echo "nginx: [emerg] unknown directive \"bad_directive\" in $conf:$line" >&2
+	exit 1
+fi
+echo "nginx: configuration file $conf test is successful" >&2
+`
+
+func TestInstanceReload(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "nginx")
+	err := os.WriteFile(bin, []byte(fakeNginx), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ConfOutDir = t.TempDir()
+	tr := parseText(t, `daemon off;
+events {}
+http {
+	server {
+		listen 80;
+	}
+}
+`)
+	inst, err := StartInstance(tr, bin, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		inst.Kill()
+		inst.Wait()
+	})
+
+	err = inst.Reload(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.ReloadError(); err != nil {
+		t.Errorf("reload error = %v, want nil", err)
+	}
+
+	err = os.WriteFile(tr.Config().Path(), []byte(`daemon off;
+events {}
+http {
+	server {
+		listen 80;
+		bad_directive;
+	}
+}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inst.Reload(tr)
+	var testErr *ConfigTestError
+	if !errors.As(err, &testErr) {
+		t.Fatalf("reload error = %v, want *ConfigTestError", err)
+	}
+	if want := " in " + tr.Config().Path() + ":6"; !strings.HasSuffix(testErr.Output, want) {
+		t.Errorf("test output = %q, want suffix %q", testErr.Output, want)
+	}
+	if inst.ReloadError() != err {
+		t.Errorf("reload error = %v, want %v", inst.ReloadError(), err)
+	}
+	cur, err := inst.versions.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur != 2 {
+		t.Errorf("current version = %d, want 2", cur)
+	}
+	versions, err := inst.versions.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("versions = %v, rejected version should be discarded", versions)
+	}
+}
@@ -34,6 +34,8 @@ type token struct {
 	Text  string
 	Value string
 	Pos   pos
+	// Space holds the white spaces and comments preceding the token.
+	Space string
 }
 
 func (tok token) Val() string {
@@ -66,6 +68,8 @@ func newLexer(input string) *lexer {
 	return &lexer{input, 0}
 }
 
+// NextToken returns the next token. When atEOF is true, tok only contains
+// the trailing Space.
 func (l *lexer) NextToken() (tok token, atEOF bool) {
 	start := l.pos
 	var r rune
@@ -78,6 +82,8 @@ loop:
 		case r == '#':
 			n := strings.IndexRune(input, '\n')
 			if n == -1 {
+				tok.Space = l.input[l.pos:]
+				l.pos = len(l.input)
 				atEOF = true
 				return
 			}
@@ -86,6 +92,10 @@ loop:
 			break loop
 		}
 	}
+	space := l.input[l.pos:start]
+	defer func() {
+		tok.Space = space
+	}()
 
 	esc := false
 	quote := rune(-1)
@@ -166,7 +176,7 @@ loop:
 			return
 		default:
 			if unicode.IsSpace(r) {
-				l.pos = i + width
+				l.pos = i
 				tok = token{
 					Text:  txt.String(),
 					Value: val.String(),
@@ -180,6 +190,7 @@ loop:
 		}
 	}
 	if start == len(l.input) {
+		l.pos = start
 		atEOF = true
 		return
 	}
@@ -192,3 +203,78 @@ loop:
 	}
 	return
 }
+
+// rawBlock reads the content of a block up to the matching "}", treating it
+// as Lua code, whose strings and comments may contain unbalanced braces.
+// It returns the position of "}".
+func (l *lexer) rawBlock() (body string, end pos, ok bool) {
+	start := l.pos
+	depth := 0
+	input := l.input
+	for i := start; i < len(input); i++ {
+		switch c := input[i]; c {
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				l.pos = i + 1
+				return input[start:i], pos(i), true
+			}
+			depth--
+		case '"', '\'':
+			for i++; i < len(input) && input[i] != c && input[i] != '\n'; i++ {
+				if input[i] == '\\' {
+					i++
+				}
+			}
+		case '[':
+			if n := longBracketLevel(input[i:]); n != -1 {
+				i = skipLongBracket(input, i, n)
+			}
+		case '-':
+			if !strings.HasPrefix(input[i:], "--") {
+				break
+			}
+			i += 2
+			if n := longBracketLevel(input[i:]); n != -1 {
+				i = skipLongBracket(input, i, n)
+				break
+			}
+			n := strings.IndexByte(input[i:], '\n')
+			if n == -1 {
+				i = len(input)
+			} else {
+				i += n
+			}
+		}
+	}
+	l.pos = len(input)
+	return "", 0, false
+}
+
+// longBracketLevel returns the level of the Lua long bracket (e.g., 2 for
+// "[==[") s starts with, or -1 if it doesn't start with one.
+func longBracketLevel(s string) int {
+	if !strings.HasPrefix(s, "[") {
+		return -1
+	}
+	n := 1
+	for n < len(s) && s[n] == '=' {
+		n++
+	}
+	if n < len(s) && s[n] == '[' {
+		return n - 1
+	}
+	return -1
+}
+
+// skipLongBracket returns the position of the last character of the long
+// bracket of the given level starting at i.
+func skipLongBracket(input string, i int, level int) int {
+	closing := "]" + strings.Repeat("=", level) + "]"
+	n := strings.Index(input[i+level+2:], closing)
+	if n == -1 {
+		return len(input)
+	}
+	return i + level + 2 + n + len(closing) - 1
+}
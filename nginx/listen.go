@@ -0,0 +1,171 @@
+package nginx
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultListenPort is the port nginx listens on if a listen directive has
+// only an address, or a server has no listen directive. nginx uses 8000
+// instead if not started by root, which is assumed not to happen, since
+// listening on port 80 for the HTTP01 challenge usually needs root.
+const DefaultListenPort = 80
+
+// Listen is a parsed listen directive.
+type Listen struct {
+	// Address is empty if listening on all addresses. IPv6 addresses are
+	// without brackets.
+	Address string
+	// Port is 0 if listening on a unix socket.
+	Port int
+	// EndPort is the last port of a port range (stream only), or equal to
+	// Port otherwise.
+	EndPort int
+	// Unix is the socket path if listening on a unix socket.
+	Unix          string
+	SSL           bool
+	QUIC          bool
+	HTTP2         bool
+	UDP           bool
+	ProxyProtocol bool
+	DefaultServer bool
+	// Params are the parameters not covered by the fields above, e.g.,
+	// "reuseport" or "backlog=511".
+	Params []string
+}
+
+// ParseListen parses the values of a listen directive.
+func ParseListen(args []string) (*Listen, error) {
+	if len(args) == 0 {
+		return nil, errors.New("missing address")
+	}
+	l := &Listen{}
+	err := l.parseAddress(args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, param := range args[1:] {
+		switch param {
+		case "ssl":
+			l.SSL = true
+		case "quic":
+			l.QUIC = true
+		case "http2":
+			l.HTTP2 = true
+		case "udp":
+			l.UDP = true
+		case "proxy_protocol":
+			l.ProxyProtocol = true
+		case "default_server", "default":
+			l.DefaultServer = true
+		default:
+			l.Params = append(l.Params, param)
+		}
+	}
+	return l, nil
+}
+
+func (l *Listen) parseAddress(addr string) error {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return fmt.Errorf("invalid unix socket: %s", addr)
+		}
+		l.Unix = path
+		return nil
+	}
+	host, port := addr, ""
+	switch {
+	case strings.HasPrefix(addr, "["):
+		i := strings.IndexByte(addr, ']')
+		if i == -1 {
+			return fmt.Errorf("invalid IPv6 address: %s", addr)
+		}
+		host = addr[1:i]
+		rest := addr[i+1:]
+		if rest != "" {
+			var ok bool
+			port, ok = strings.CutPrefix(rest, ":")
+			if !ok {
+				return fmt.Errorf("invalid address: %s", addr)
+			}
+		}
+	case isPort(addr):
+		host, port = "", addr
+	default:
+		if i := strings.LastIndexByte(addr, ':'); i != -1 {
+			host, port = addr[:i], addr[i+1:]
+		}
+	}
+	if host == "*" {
+		host = ""
+	}
+	l.Address = host
+	if port == "" {
+		l.Port = DefaultListenPort
+		l.EndPort = DefaultListenPort
+		return nil
+	}
+	start, end, isRange := strings.Cut(port, "-")
+	var err error
+	l.Port, err = parsePort(start)
+	if err != nil {
+		return fmt.Errorf("invalid port in %s", addr)
+	}
+	l.EndPort = l.Port
+	if isRange {
+		l.EndPort, err = parsePort(end)
+		if err != nil || l.EndPort < l.Port {
+			return fmt.Errorf("invalid port range in %s", addr)
+		}
+	}
+	return nil
+}
+
+func isPort(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func parsePort(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > 65535 {
+		return 0, errors.New("port out of range")
+	}
+	return n, nil
+}
+
+// NeedsCert reports whether nginx requires a certificate for the listener.
+func (l *Listen) NeedsCert() bool {
+	return l.SSL || l.QUIC
+}
+
+// HasPort reports whether the listener accepts TCP connections on port.
+func (l *Listen) HasPort(port int) bool {
+	return l.Unix == "" && !l.UDP && !l.QUIC && l.Port <= port && port <= l.EndPort
+}
+
+// ServesHTTP01 reports whether the listener can answer the HTTP01 challenge,
+// which is always sent to port 80 over plain HTTP.
+func (l *Listen) ServesHTTP01() bool {
+	return !l.NeedsCert() && l.HasPort(80)
+}
+
+func (d *SimpleDirective) ListenArg() (*Listen, error) {
+	l, err := ParseListen(d.args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w in %s", d.name, err, loc(d))
+	}
+	return l, nil
+}
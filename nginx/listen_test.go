@@ -0,0 +1,91 @@
+package nginx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseListen(t *testing.T) {
+	tests := []struct {
+		args []string
+		want *Listen
+	}{
+		{[]string{"80"}, &Listen{Port: 80, EndPort: 80}},
+		{[]string{"*:443", "ssl", "http2"}, &Listen{Port: 443, EndPort: 443, SSL: true, HTTP2: true}},
+		{[]string{"127.0.0.1"}, &Listen{Address: "127.0.0.1", Port: 80, EndPort: 80}},
+		{[]string{"example.com:8080", "default_server"}, &Listen{Address: "example.com", Port: 8080, EndPort: 8080, DefaultServer: true}},
+		{[]string{"[::]:443", "quic", "reuseport"}, &Listen{Address: "::", Port: 443, EndPort: 443, QUIC: true, Params: []string{"reuseport"}}},
+		{[]string{"[::1]"}, &Listen{Address: "::1", Port: 80, EndPort: 80}},
+		{[]string{"unix:/run/nginx.sock", "proxy_protocol"}, &Listen{Unix: "/run/nginx.sock", ProxyProtocol: true}},
+		{[]string{"5000-5010", "udp"}, &Listen{Port: 5000, EndPort: 5010, UDP: true}},
+	}
+	for _, test := range tests {
+		got, err := ParseListen(test.args)
+		if err != nil {
+			t.Errorf("ParseListen(%q) failed: %v", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseListen(%q) = %+v, want %+v", test.args, got, test.want)
+		}
+	}
+
+	for _, args := range [][]string{{}, {"unix:"}, {"[::1"}, {"[::1]80"}, {"a.com:0"}, {"a.com:x"}, {"90-80"}} {
+		_, err := ParseListen(args)
+		if err == nil {
+			t.Errorf("ParseListen(%q) should fail", args)
+		}
+	}
+}
+
+func TestListenServesHTTP01(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"80"}, true},
+		{[]string{"localhost"}, true},
+		{[]string{"[::]:80", "default_server"}, true},
+		{[]string{"8080"}, false},
+		{[]string{"80", "ssl"}, false},
+		{[]string{"443", "quic"}, false},
+		{[]string{"unix:/run/nginx.sock"}, false},
+	}
+	for _, test := range tests {
+		l, err := ParseListen(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := l.ServesHTTP01(); got != test.want {
+			t.Errorf("ServesHTTP01 of %q = %v, want %v", test.args, got, test.want)
+		}
+	}
+}
+
+func TestServerListens(t *testing.T) {
+	tr := parseText(t, `http {
+	server {
+		listen 443 quic;
+		server_name quic.com;
+	}
+	server {
+		listen 8080;
+	}
+	server {
+		server_name default.com;
+	}
+}
+`)
+	ap, err := tr.PrepareACME()
+	if err != nil {
+		t.Fatal(err)
+	}
+	https := ap.extractor.httpsServerBlocks
+	if len(https) != 1 || https[0].domains[0] != "quic.com" {
+		t.Errorf("quic-only server should need a certificate")
+	}
+	http := ap.extractor.httpServerBlocks
+	if len(http) != 1 || http[0].domains[0] != "default.com" {
+		t.Errorf("only the server listening on port 80 by default should serve the HTTP01 challenge")
+	}
+}
@@ -0,0 +1,135 @@
+package nginx
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hgl/acmehugger/acme"
+	"github.com/hgl/acmehugger/internal/metrics"
+)
+
+// Metrics records what nginxh does, in the Prometheus text format. A nil
+// *Metrics records nothing.
+type Metrics struct {
+	reg           *metrics.Registry
+	certNotAfter  *metrics.Family
+	certRenewAt   *metrics.Family
+	issuances     *metrics.Family
+	accountErrors *metrics.Family
+	reloads       *metrics.Family
+	hookRuns      *metrics.Family
+	hookDuration  *metrics.Family
+}
+
+func NewMetrics() *Metrics {
+	reg := metrics.New()
+	return &Metrics{
+		reg: reg,
+		certNotAfter: reg.Gauge("acmehugger_certificate_not_after_seconds",
+			"When the certificate expires, in seconds since the Unix epoch.", "server", "domain"),
+		certRenewAt: reg.Gauge("acmehugger_certificate_renew_at_seconds",
+			"When the certificate is renewed next, in seconds since the Unix epoch.", "server", "domain"),
+		issuances: reg.Counter("acmehugger_issuances_total",
+			"Certificate issuance attempts.", "server", "challenge", "result"),
+		accountErrors: reg.Counter("acmehugger_account_errors_total",
+			"Failures to load or register ACME accounts.", "server"),
+		reloads: reg.Counter("acmehugger_nginx_reloads_total",
+			"Nginx reloads.", "result"),
+		hookRuns: reg.Counter("acmehugger_hook_runs_total",
+			"Hook runs.", "hook", "result"),
+		hookDuration: reg.Summary("acmehugger_hook_duration_seconds",
+			"How long hooks run.", "hook"),
+	}
+}
+
+// Serve serves the metrics at /metrics on the listener, until it's closed.
+func (m *Metrics) Serve(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.reg)
+	err := http.Serve(ln, mux)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// serveMetrics listens on addr and serves new metrics in the background.
+func serveMetrics(addr string) (*Metrics, net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := NewMetrics()
+	go func() {
+		err := m.Serve(ln)
+		if err != nil {
+			slog.Error("failed to serve metrics", "error", err)
+		}
+	}()
+	slog.Debug("serving metrics", "addr", ln.Addr())
+	return m, ln, nil
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func (m *Metrics) accountFailed(acct *acme.Account) {
+	if m == nil {
+		return
+	}
+	m.accountErrors.Inc(acct.ResolveServer())
+}
+
+// issued records the result of issuing a certificate. info is nil if it
+// failed, and its Changed is false if the certificate is not due for
+// renewal.
+func (m *Metrics) issued(acct *acme.Account, opts *acme.IssueOptions, info *acme.IssueInfo, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil || info.Changed {
+		m.issuances.Inc(acct.ResolveServer(), opts.Challenge.String(), result(err))
+	}
+}
+
+// certIssued records when the issued certificate expires and is renewed.
+func (m *Metrics) certIssued(acct *acme.Account, domains []string, info *acme.IssueInfo) {
+	if m == nil {
+		return
+	}
+	server := acct.ResolveServer()
+	m.certNotAfter.Set(float64(info.NotAfter.Unix()), server, domains[0])
+	m.certRenewAt.Set(float64(info.RenewAt.Unix()), server, domains[0])
+}
+
+// resetCerts forgets the certificates, before the configs are processed
+// again.
+func (m *Metrics) resetCerts() {
+	if m == nil {
+		return
+	}
+	m.certNotAfter.Reset()
+	m.certRenewAt.Reset()
+}
+
+func (m *Metrics) reloaded(err error) {
+	if m == nil {
+		return
+	}
+	m.reloads.Inc(result(err))
+}
+
+func (m *Metrics) hookRan(name string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.hookRuns.Inc(name, result(err))
+	m.hookDuration.Observe(d.Seconds(), name)
+}
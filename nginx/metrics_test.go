@@ -0,0 +1,138 @@
+package nginx
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hgl/acmehugger/acme"
+)
+
+func TestMetrics(t *testing.T) {
+	// a nil *Metrics records nothing
+	var nilMetrics *Metrics
+	nilMetrics.reloaded(nil)
+
+	m := NewMetrics()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go m.Serve(ln)
+
+	acct := &acme.Account{Server: "https://ca.example/dir"}
+	opts := &acme.IssueOptions{Challenge: acme.ChallengeDNS}
+	notAfter := time.Unix(2000, 0)
+	info := &acme.IssueInfo{
+		Changed:  true,
+		NotAfter: notAfter,
+		RenewAt:  notAfter.Add(-1000 * time.Second),
+	}
+	m.issued(acct, opts, info, nil)
+	m.certIssued(acct, []string{"a.com"}, info)
+	// not due for renewal
+	m.issued(acct, opts, &acme.IssueInfo{
+		NotAfter: notAfter,
+		RenewAt:  notAfter.Add(-1000 * time.Second),
+	}, nil)
+	m.issued(acct, opts, nil, errors.New("failed"))
+	m.accountFailed(acct)
+	m.reloaded(nil)
+	m.reloaded(errors.New("failed"))
+	m.hookRan("a.sh", 1500*time.Millisecond, nil)
+	m.hookRan("a.sh", 500*time.Millisecond, nil)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{
+		"# TYPE acmehugger_certificate_not_after_seconds gauge\n",
+		`acmehugger_certificate_not_after_seconds{server="https://ca.example/dir",domain="a.com"} 2000` + "\n",
+		`acmehugger_certificate_renew_at_seconds{server="https://ca.example/dir",domain="a.com"} 1000` + "\n",
+		`acmehugger_issuances_total{server="https://ca.example/dir",challenge="dns",result="success"} 1` + "\n",
+		`acmehugger_issuances_total{server="https://ca.example/dir",challenge="dns",result="failure"} 1` + "\n",
+		`acmehugger_account_errors_total{server="https://ca.example/dir"} 1` + "\n",
+		`acmehugger_nginx_reloads_total{result="success"} 1` + "\n",
+		`acmehugger_nginx_reloads_total{result="failure"} 1` + "\n",
+		`acmehugger_hook_runs_total{hook="a.sh",result="success"} 2` + "\n",
+		`acmehugger_hook_duration_seconds_sum{hook="a.sh"} 2` + "\n",
+		`acmehugger_hook_duration_seconds_count{hook="a.sh"} 2` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics should contain %q, got\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `domain="b.com"`) {
+		t.Errorf("failed certificates should have no expiry, got\n%s", got)
+	}
+
+	m.resetCerts()
+	var b strings.Builder
+	err = m.reg.WriteText(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), `domain="a.com"`) {
+		t.Errorf("certificates should be reset, got\n%s", b.String())
+	}
+}
+
+func TestStoppedProcessorMetrics(t *testing.T) {
+	acme.AccountsDir = t.TempDir()
+	acme.CertsDir = t.TempDir()
+	acme.ChallengeDir = t.TempDir()
+	issuing := make(chan struct{})
+	release := make(chan struct{})
+	acme.SetDefaultHandler(&handlerStub{
+		createAccount: func(acct *acme.HandlerAccount) error {
+			return nil
+		},
+		issue: func(acct *acme.HandlerAccount, domains []string, opts *acme.IssueOptions) (*acme.Cert, error) {
+			close(issuing)
+			<-release
+			return issueSelfSigned(acct, domains, opts)
+		},
+	})
+	tr := parseText(t, `acme {
+	acme_server https://ca.example/dir;
+	acme_domain a.com;
+}
+`)
+	ap, err := tr.PrepareACME()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	ap.SetMetrics(m)
+	changed := ap.Process()
+	<-issuing
+	ap.Stop()
+	m.resetCerts()
+	close(release)
+	for range changed {
+	}
+
+	var b strings.Builder
+	err = m.reg.WriteText(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), `domain="a.com"`) {
+		t.Errorf("stopped processors should not record certificates, got\n%s", b.String())
+	}
+	if want := `acmehugger_issuances_total{server="https://ca.example/dir",challenge="http",result="success"} 1` + "\n"; !strings.Contains(b.String(), want) {
+		t.Errorf("metrics should contain %q, got\n%s", want, b.String())
+	}
+}
@@ -5,3 +5,10 @@ import "github.com/hgl/acmehugger"
 var ConfDir = "/etc/nginx"
 var Conf = ConfDir + "/nginx.conf"
 var ConfOutDir = acmehugger.StateDir + "/nginx/conf"
+
+// PidFile is where nginxh writes its PID, for "nginxh -s" to signal it.
+var PidFile = acmehugger.StateDir + "/nginx/nginxh.pid"
+
+// ControlSocket is the unix socket on which nginxh serves its control API,
+// if ACMEHUGGER_CONTROL is set.
+var ControlSocket = acmehugger.StateDir + "/nginx/nginxh.sock"
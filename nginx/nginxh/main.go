@@ -2,6 +2,7 @@ package main
 
 import (
 	"log/slog"
+	"os"
 
 	"github.com/hgl/acmehugger/nginx"
 )
@@ -10,5 +11,6 @@ func main() {
 	err := nginx.Start()
 	if err != nil {
 		slog.Error(err.Error())
+		os.Exit(nginx.ExitCode(err))
 	}
 }
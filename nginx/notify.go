@@ -0,0 +1,37 @@
+package nginx
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/hgl/acmehugger/internal/sdnotify"
+)
+
+// notify sends the states to systemd, along with the status of nginxh.
+func (r *runner) notify(states ...string) {
+	if !sdnotify.Enabled() {
+		return
+	}
+	err := sdnotify.Notify(append(states, sdnotify.Status(r.status()))...)
+	if err != nil {
+		slog.Debug("failed to notify systemd", "error", err)
+	}
+}
+
+// status summarizes the states of the config and certificates in a line.
+func (r *runner) status() string {
+	var parts []string
+	if r.renderErr != nil {
+		parts = append(parts, "failed to reload config: "+r.renderErr.Error())
+	} else if r.inst != nil {
+		if err := r.inst.ReloadError(); err != nil {
+			parts = append(parts, "failed to reload nginx: "+err.Error())
+		}
+	}
+	if r.ap != nil {
+		st := r.ap.CertStatus()
+		parts = append(parts, fmt.Sprintf("certificates: %d ready, %d pending, %d failing", st.Ready, st.Pending, st.Failing))
+	}
+	return strings.Join(strings.Fields(strings.Join(parts, "; ")), " ")
+}
@@ -0,0 +1,79 @@
+package nginx
+
+import (
+	"net"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunnerNotify(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", name)
+	t.Setenv("WATCHDOG_USEC", "20000")
+
+	// runs for a while, ignoring reloads, then exits
+	bin, conf := writeNginx(t, "trap '' HUP\nsleep 0.2\n", "daemon off;\nevents {}\n")
+
+	first := make(chan string, 1)
+	received := make(chan []string)
+	go func() {
+		var msgs []string
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				received <- msgs
+				return
+			}
+			msgs = append(msgs, string(buf[:n]))
+			if len(msgs) == 1 {
+				first <- msgs[0]
+			}
+		}
+	}()
+	r := newRunner(conf, bin, nil, nil)
+	runErr := make(chan error)
+	go func() {
+		runErr <- r.run()
+	}()
+	want := "READY=1\nSTATUS=certificates: 0 ready, 0 pending, 0 failing"
+	if msg := <-first; msg != want {
+		t.Errorf("first notification = %q, want %q", msg, want)
+	}
+	r.control(r.rerender)
+	err = <-runErr
+	if err == nil {
+		t.Errorf("nginx exiting should be an error")
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	msgs := <-received
+	if !slices.ContainsFunc(msgs, func(msg string) bool {
+		return strings.HasPrefix(msg, "WATCHDOG=1\n")
+	}) {
+		t.Errorf("notifications %q should contain watchdog pings", msgs)
+	}
+	i := slices.IndexFunc(msgs, func(msg string) bool {
+		return strings.HasPrefix(msg, "RELOADING=1\n")
+	})
+	if i == -1 {
+		t.Fatalf("notifications %q should contain reloading", msgs)
+	}
+	if runtime.GOOS == "linux" {
+		// systemd rejects reloading without the time it started
+		usec, _, _ := strings.Cut(strings.TrimPrefix(msgs[i], "RELOADING=1\nMONOTONIC_USEC="), "\n")
+		if n, err := strconv.ParseInt(usec, 10, 64); err != nil || n <= 0 {
+			t.Errorf("reloading notification %q should contain MONOTONIC_USEC", msgs[i])
+		}
+	}
+}
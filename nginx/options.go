@@ -0,0 +1,159 @@
+package nginx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+// hasOption reports whether the nginx flag opt, like 't', is in args, either
+// alone or combined with other flags, like "-tq".
+func hasOption(args []string, opt byte) bool {
+	_, ok := optionValue(args, opt)
+	return ok
+}
+
+// optionValue returns the value of the nginx option opt, like 's', and
+// reports whether it's in args. The value either follows the option in the
+// same argument, like "-qsreload", or is the next argument. It's empty for
+// flags without values.
+func optionValue(args []string, opt byte) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' {
+			continue
+		}
+		for j := 1; j < len(arg); j++ {
+			if strings.IndexByte("pcegs", arg[j]) == -1 {
+				if arg[j] == opt {
+					return "", true
+				}
+				continue
+			}
+			// the rest or the next argument is the option's value
+			value := arg[j+1:]
+			if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if arg[j] == opt {
+				return value, true
+			}
+			break
+		}
+	}
+	return "", false
+}
+
+// TestConfig generates the config from the tree without issuing
+// certificates, and runs nginx with args, which contain -t or -T, to test
+// it. The locations in nginx's error messages point to the original
+// configs.
+func TestConfig(tr *Tree, bin string, args []string) error {
+	_, err := tr.PrepareACME()
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "nginxh")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	name, err := tr.Dump(dir)
+	if err != nil {
+		return err
+	}
+	cmd := command(tr, bin, args, name)
+	err = cmd.Run()
+	flushStderr(cmd)
+	if err != nil {
+		return fmt.Errorf("config test failed: %w", err)
+	}
+	return nil
+}
+
+// runNginx runs nginx with args as they are, for options like -v that
+// don't need the config.
+func runNginx(bin string, args []string) error {
+	cmd := exec.Command(bin, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// checkPidFile returns an error if PidFile names a running process other
+// than nginxh itself, which is presumably another nginxh.
+func checkPidFile() error {
+	pid, err := readPidFile(PidFile, time.Time{})
+	if err != nil || pid == os.Getpid() {
+		// a missing or invalid PID file names no process
+		return nil
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil
+	}
+	err = proc.Signal(syscall.Signal(0))
+	if err != nil && !errors.Is(err, syscall.EPERM) {
+		return nil
+	}
+	return fmt.Errorf("nginxh is already running with PID %d, according to %s", pid, PidFile)
+}
+
+// writePidFile writes the PID of nginxh to PidFile, unless it names another
+// running nginxh.
+func writePidFile() error {
+	err := checkPidFile()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(PidFile), 0755)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(PidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644, -1, -1)
+}
+
+// removePidFile removes PidFile, unless it's been taken over by another
+// nginxh.
+func removePidFile() {
+	pid, err := readPidFile(PidFile, time.Time{})
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	os.Remove(PidFile)
+}
+
+// signalRunning sends the signal named by the argument of nginx's -s option
+// to the running nginxh, which handles it like nginx does.
+func signalRunning(name string) error {
+	if len(signalNames) == 0 {
+		return fmt.Errorf("the -s option is not supported on %s", runtime.GOOS)
+	}
+	sig, ok := signalNames[name]
+	if !ok {
+		return fmt.Errorf("invalid -s argument: %q", name)
+	}
+	pid, err := readPidFile(PidFile, time.Time{})
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("nginxh is not running, %s does not exist", PidFile)
+	}
+	if err != nil {
+		return err
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(sig)
+}
@@ -0,0 +1,188 @@
+package nginx
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+func TestHasOption(t *testing.T) {
+	tests := []struct {
+		args []string
+		opt  byte
+		want bool
+	}{
+		{[]string{"-t"}, 't', true},
+		{[]string{"-q", "-t"}, 't', true},
+		{[]string{"-qt"}, 't', true},
+		{[]string{"-p", "-t"}, 't', false},
+		{[]string{"-pt"}, 't', false},
+		{[]string{"-g", "daemon off;", "-T"}, 'T', true},
+		{[]string{"-V"}, 't', false},
+	}
+	for _, tt := range tests {
+		got := hasOption(tt.args, tt.opt)
+		if got != tt.want {
+			t.Errorf("hasOption(%q, %q) = %v, want %v", tt.args, tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestOptionValue(t *testing.T) {
+	tests := []struct {
+		args  []string
+		opt   byte
+		value string
+		ok    bool
+	}{
+		{[]string{"-s", "reload"}, 's', "reload", true},
+		{[]string{"-sreload"}, 's', "reload", true},
+		{[]string{"-qs", "reload"}, 's', "reload", true},
+		{[]string{"-qsreload"}, 's', "reload", true},
+		{[]string{"-p", "-s", "-t"}, 's', "", false},
+		{[]string{"-g", "daemon off;"}, 'g', "daemon off;", true},
+		{[]string{"-s"}, 's', "", true},
+		{[]string{"-q"}, 's', "", false},
+	}
+	for _, tt := range tests {
+		value, ok := optionValue(tt.args, tt.opt)
+		if value != tt.value || ok != tt.ok {
+			t.Errorf("optionValue(%q, %q) = %q, %v, want %q, %v", tt.args, tt.opt, value, ok, tt.value, tt.ok)
+		}
+	}
+}
+
+func TestTestConfig(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "nginx")
+	// records the tested config
+	err := os.WriteFile(bin, []byte(`#!/bin/sh
+while [ "$1" != -c ]; do
+	shift
+done
+cat "$2" > "$0.conf"
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := parseText(t, "acme_email test@example.com;\nevents {}\n")
+	err = TestConfig(tr, bin, []string{"-t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := util.ReadText(bin + ".conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// acme directives are removed
+	if want := "\nevents {}\n"; got != want {
+		t.Errorf("tested config = %q, want %q", got, want)
+	}
+
+	tr = parseText(t, "events {}\n")
+	err = TestConfig(tr, filepath.Join(dir, "missing"), []string{"-t"})
+	if err == nil {
+		t.Errorf("failed config test should return an error")
+	}
+}
+
+func TestSignalRunning(t *testing.T) {
+	PidFile = filepath.Join(t.TempDir(), "nginxh.pid")
+	err := signalRunning("stop")
+	if err == nil {
+		t.Errorf("signaling without a PID file should return an error")
+	}
+	err = writePidFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	removePidFile()
+	exist, err := util.FileExist(PidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exist {
+		t.Errorf("PID file should be removed")
+	}
+
+	cmd := exec.Command("sleep", "60")
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(PidFile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = signalRunning("reopen!")
+	if err == nil {
+		t.Errorf("invalid signal name should return an error")
+	}
+	err = signalRunning("stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Wait()
+	if code := ExitCode(err); code != 128+int(syscall.SIGTERM) {
+		t.Errorf("exit code = %d, process should be killed by SIGTERM", code)
+	}
+	// taken over by another nginxh
+	removePidFile()
+	exist, err = util.FileExist(PidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist {
+		t.Errorf("PID file of another process should be kept")
+	}
+}
+
+func TestSecondInstance(t *testing.T) {
+	PidFile = filepath.Join(t.TempDir(), "nginxh.pid")
+	// the running nginxh
+	cmd := exec.Command("sleep", "60")
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(PidFile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkPidFile()
+	if err == nil {
+		t.Errorf("starting a second nginxh should return an error")
+	}
+	err = writePidFile()
+	if err == nil {
+		t.Errorf("writing the PID file of a second nginxh should return an error")
+	}
+	pid, err := readPidFile(PidFile, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != cmd.Process.Pid {
+		t.Errorf("PID file of the running nginxh should be kept")
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	// the PID file is left over
+	err = writePidFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err = readPidFile(PidFile, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("PID file = %d, want %d", pid, os.Getpid())
+	}
+}
@@ -32,6 +32,7 @@ func Parse(name string, confdir string) (*Tree, error) {
 
 func (tr *Tree) Parse() error {
 	tr.includedConfs = make(map[string]*Config)
+	tr.includeGlobs = nil
 	conf, err := tr.newConfig(tr.name, nil, nil)
 	tr.conf = conf
 	return err
@@ -66,50 +67,64 @@ func (tr *Tree) newConfig(name string, parent *IncludeDirective, parentBlock *Bl
 }
 
 func (conf *Config) parseDirectives() ([]Directive, error) {
-	var ds []Directive
-	for {
-		tok, atEOF := conf.lexer.NextToken()
-		if atEOF {
-			return ds, nil
-		}
-		switch tok.Type {
-		case tokenPunc:
-			if tok.Text != ";" {
-				return nil, conf.unexpected(tok)
-			}
-		case tokenLiteral:
-			d, err := conf.parseDirective(tok, conf, conf.parentBlock)
-			if err != nil {
-				return nil, err
-			}
-			ds = append(ds, d)
-		default:
-			panic("unknown tokenType")
-		}
-	}
+	ds, trailing, _, err := conf.parseChildren(conf, conf.parentBlock)
+	conf.trailing = trailing
+	return ds, err
 }
 
 func (d *BlockDirective) parseDirectives() ([]Directive, error) {
+	ds, closeSpace, closePos, err := d.conf.parseChildren(d, d)
+	d.closeSpace = closeSpace
+	d.closePos = closePos
+	return ds, err
+}
+
+// parseChildren parses directives until the end of the config, or the "}"
+// closing parentBlock if parent is a block. It also returns the space
+// preceding the end, and the position of "}".
+func (conf *Config) parseChildren(parent any, parentBlock *BlockDirective) ([]Directive, string, pos, error) {
+	_, inBlock := parent.(*BlockDirective)
 	var ds []Directive
+	var space strings.Builder
 	for {
-		tok, atEOF := d.conf.lexer.NextToken()
+		tok, atEOF := conf.lexer.NextToken()
+		if space.Len() == 0 {
+			var trail string
+			trail, tok.Space = splitTrail(tok.Space)
+			if len(ds) != 0 {
+				ds[len(ds)-1].layoutInfo().trail = trail
+			} else if inBlock {
+				parentBlock.openTrail = trail
+			} else {
+				space.WriteString(trail)
+			}
+		}
+		space.WriteString(tok.Space)
 		if atEOF {
-			return nil, io.ErrUnexpectedEOF
+			if inBlock {
+				return nil, "", 0, io.ErrUnexpectedEOF
+			}
+			return ds, space.String(), pos(len(conf.text)), nil
 		}
 		switch tok.Type {
 		case tokenPunc:
-			switch tok.Text {
-			case "}":
-				return ds, nil
-			case ";":
+			switch {
+			case tok.Text == "}" && inBlock:
+				return ds, space.String(), tok.Pos, nil
+			case tok.Text == ";":
+				// Stray semicolons are kept as spaces, so that they can be
+				// dumped as is.
+				space.WriteString(tok.Text)
 			default:
-				return nil, d.conf.unexpected(tok)
+				return nil, "", 0, conf.unexpected(tok)
 			}
 		case tokenLiteral:
-			d, err := d.conf.parseDirective(tok, d, d)
+			d, err := conf.parseDirective(tok, parent, parentBlock)
 			if err != nil {
-				return nil, err
+				return nil, "", 0, err
 			}
+			d.layoutInfo().space = space.String()
+			space.Reset()
 			ds = append(ds, d)
 		default:
 			panic("unknown tokenType")
@@ -117,9 +132,19 @@ func (d *BlockDirective) parseDirectives() ([]Directive, error) {
 	}
 }
 
+// splitTrail splits the space following a directive into the part on the
+// same line and the rest.
+func splitTrail(space string) (trail string, rest string) {
+	i := strings.IndexByte(space, '\n')
+	if i == -1 {
+		return "", space
+	}
+	return space[:i], space[i:]
+}
+
 func (conf *Config) parseDirective(nameTok token, parent any, parentBlock *BlockDirective) (Directive, error) {
 	name := nameTok.Value
-	if name == "include" {
+	if name == "include" && !conf.tr.skipIncludes {
 		return conf.parseInclude(nameTok.Pos, parent, parentBlock)
 	}
 
@@ -147,6 +172,7 @@ outer:
 	case ";":
 		return &SimpleDirective{
 			pos:         nameTok.Pos,
+			layout:      layout{end: tok.Pos + 1},
 			name:        name,
 			args:        args,
 			raw:         raw,
@@ -155,8 +181,12 @@ outer:
 			parentBlock: parentBlock,
 		}, nil
 	case "{":
+		if isRawBlock(name) {
+			return conf.parseRawBlock(nameTok, args, raw, parent, parentBlock)
+		}
 		bd := &BlockDirective{
 			pos:         nameTok.Pos,
+			layout:      layout{end: tok.Pos + 1},
 			name:        name,
 			args:        args,
 			raw:         raw,
@@ -175,6 +205,24 @@ outer:
 	}
 }
 
+func (conf *Config) parseRawBlock(nameTok token, args []string, raw []string, parent any, parentBlock *BlockDirective) (*RawBlockDirective, error) {
+	body, closePos, ok := conf.lexer.rawBlock()
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &RawBlockDirective{
+		pos:         nameTok.Pos,
+		layout:      layout{end: closePos + 1},
+		name:        nameTok.Value,
+		args:        args,
+		raw:         raw,
+		Body:        body,
+		conf:        conf,
+		parent:      parent,
+		parentBlock: parentBlock,
+	}, nil
+}
+
 func (conf *Config) parseInclude(p pos, parent any, parentBlock *BlockDirective) (*IncludeDirective, error) {
 	targetTok, atEOF := conf.lexer.NextToken()
 	if atEOF {
@@ -193,6 +241,7 @@ func (conf *Config) parseInclude(p pos, parent any, parentBlock *BlockDirective)
 	}
 	d := &IncludeDirective{
 		pos:         p,
+		layout:      layout{end: tok.Pos + 1},
 		Target:      targetTok.Value,
 		conf:        conf,
 		parent:      parent,
@@ -209,6 +258,7 @@ func (conf *Config) parseInclude(p pos, parent any, parentBlock *BlockDirective)
 		if err != nil {
 			return nil, err
 		}
+		conf.tr.includeGlobs = append(conf.tr.includeGlobs, target)
 		if len(names) == 0 {
 			return d, nil
 		}
@@ -3,6 +3,7 @@ package nginx
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -85,3 +86,101 @@ func TestParseErr(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMap(t *testing.T) {
+	tr := parseText(t, `http {
+	map $uri $v {
+		hostnames;
+		default 0;
+		~^/a/(?<n>\d+)$ 1;
+		"~^/b{2};$" 2;
+		'}' "3 4";
+	}
+}
+`)
+	m := tr.Config().Children[0].(*BlockDirective).Children[0].(*BlockDirective)
+	var got [][]string
+	for _, child := range m.Children {
+		d := child.(*SimpleDirective)
+		got = append(got, append([]string{d.Name()}, d.Args()...))
+	}
+	want := [][]string{
+		{"hostnames"},
+		{"default", "0"},
+		{`~^/a/(?<n>\d+)$`, "1"},
+		{"~^/b{2};$", "2"},
+		{"}", "3 4"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("map entries = %q, want %q", got, want)
+	}
+	n, err := tr.Dump(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\t\t~^/a/(?<n>\\d+)$ 1;\n\t\t\"~^/b{2};$\" 2;\n\t\t'}' \"3 4\";\n"; !strings.Contains(string(data), want) {
+		t.Errorf("dumped\n%s\nwant it to contain\n%s", data, want)
+	}
+}
+
+func TestRawBlock(t *testing.T) {
+	name := "testdata/parse/lua.in.conf"
+	tr, err := Parse(name, "testdata/parse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := tr.Config().Children[0].(*BlockDirective).Children[0].(*BlockDirective)
+	location := server.Children[0].(*BlockDirective)
+	d, ok := location.Children[0].(*RawBlockDirective)
+	if !ok {
+		t.Fatalf("got %T, want *RawBlockDirective", location.Children[0])
+	}
+	if want := "\n\t\t\t\tlocal t = { a = \"}\" } -- }\n"; !strings.HasPrefix(d.Body, want) {
+		t.Errorf("body = %q, want prefix %q", d.Body, want)
+	}
+	d = server.Children[1].(*RawBlockDirective)
+	d.SetBody(" ngx.exit(404) ")
+	tmpDir := t.TempDir()
+	n, err := tr.Dump(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\t\taccess_by_lua_block { ngx.exit(404) }\n"; !strings.Contains(string(data), want) {
+		t.Errorf("dumped\n%s\nwant it to contain\n%s", data, want)
+	}
+
+	RegisterRawBlock("foo_block")
+	defer func() {
+		rawBlocksMu.Lock()
+		delete(rawBlocks, "foo_block")
+		rawBlocksMu.Unlock()
+	}()
+	confName := filepath.Join(t.TempDir(), "raw.conf")
+	err = os.WriteFile(confName, []byte("foo_block { a { ; }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Parse(confName, filepath.Dir(confName))
+	if err == nil {
+		t.Errorf("unterminated raw block should fail to parse")
+	}
+	err = os.WriteFile(confName, []byte("foo_block { a { ; } }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err = Parse(confName, filepath.Dir(confName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := tr.Config().Children[0].(*RawBlockDirective).Body; body != " a { ; } " {
+		t.Errorf("body = %q, want %q", body, " a { ; } ")
+	}
+}
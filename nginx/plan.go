@@ -0,0 +1,219 @@
+package nginx
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hgl/acmehugger/acme"
+	"github.com/hgl/acmehugger/internal/clock"
+	"github.com/hgl/acmehugger/internal/diff"
+	"github.com/hgl/acmehugger/internal/set"
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+// Plan describes what nginxh does with a tree, according to the current
+// state of certificates.
+type Plan struct {
+	Certs []*CertPlan
+	// Diff is the unified diff from the configs to the generated ones.
+	Diff string
+}
+
+// CertPlan describes the certificate required by a server or acme block.
+type CertPlan struct {
+	// Block is the location of the block.
+	Block     string
+	Domains   []string
+	Email     string
+	Server    string
+	Challenge acme.ChallengeType
+	KeyType   acme.KeyType
+	// Exists is true if the certificate has been issued, in which case
+	// NotAfter and RenewAt are set.
+	Exists   bool
+	NotAfter time.Time
+	RenewAt  time.Time
+	// Reissue is true if the certificate exists but doesn't cover the
+	// domains, so a new one is issued.
+	Reissue bool
+	// Deferred are the directives omitted until the certificate exists. If
+	// the whole block is omitted, the block itself is the first one.
+	Deferred []string
+}
+
+// Plan processes the tree like PrepareACME, without issuing certificates,
+// and returns what would be done. The tree is modified as for nginx.
+func (tr *Tree) Plan() (*Plan, error) {
+	ap, err := tr.PrepareACME()
+	if err != nil {
+		return nil, err
+	}
+	var plan Plan
+	for _, s := range ap.extractor.httpsServerBlocks {
+		cp, err := newCertPlan(s.dire, s.domains, s.acct, s.issueOpts)
+		if err != nil {
+			return nil, err
+		}
+		if s.deferredBlk != nil {
+			cp.Deferred = append(cp.Deferred, "server")
+		}
+		for _, d := range s.dire.Children {
+			if d, ok := d.(*DeferredDirective); ok {
+				cp.Deferred = append(cp.Deferred, strings.Join(append([]string{d.Name()}, d.Args()...), " "))
+			}
+		}
+		plan.Certs = append(plan.Certs, cp)
+	}
+	for _, a := range ap.extractor.acmeBlocks {
+		cp, err := newCertPlan(a.dire, a.domains, a.acct, a.issueOpts)
+		if err != nil {
+			return nil, err
+		}
+		plan.Certs = append(plan.Certs, cp)
+	}
+	plan.Diff, err = tr.diff()
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+func newCertPlan(b *BlockDirective, domains []string, acct *acme.Account, opts *acme.IssueOptions) (*CertPlan, error) {
+	cp := &CertPlan{
+		Block:     b.Location(),
+		Domains:   domains,
+		Email:     acct.Email,
+		Server:    acct.ResolveServer(),
+		Challenge: opts.Challenge,
+		KeyType:   opts.KeyType,
+	}
+	paths, err := acct.CertPaths(domains[0])
+	if err != nil {
+		return nil, err
+	}
+	cp.Exists, err = paths.Exist()
+	if err != nil {
+		return nil, err
+	}
+	if !cp.Exists {
+		return cp, nil
+	}
+	crt, err := util.ReadCert(paths.FullChain)
+	if err != nil {
+		return nil, err
+	}
+	cp.NotAfter = crt.NotAfter
+	cp.RenewAt = crt.NotAfter.Add(-opts.RenewBefore())
+	cp.Reissue = !set.EqualSet(crt.DNSNames, domains)
+	return cp, nil
+}
+
+// diff dumps the tree into a temporary directory, and returns the diff from
+// each config to its generated one.
+func (tr *Tree) diff() (string, error) {
+	dir, err := os.MkdirTemp("", "nginxh")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	_, err = tr.Dump(dir)
+	defer tr.srcMap.forget(dir)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for name := range tr.includedConfs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	confs := []*Config{tr.conf}
+	for _, name := range names {
+		confs = append(confs, tr.includedConfs[name])
+	}
+	var b strings.Builder
+	for _, conf := range confs {
+		data, err := os.ReadFile(filepath.Join(dir, conf.path))
+		if errors.Is(err, os.ErrNotExist) {
+			// not included in the generated configs
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(diff.Unified(conf.path, conf.path+" (generated)", conf.text, string(data)))
+	}
+	return b.String(), nil
+}
+
+func (p *Plan) String() string {
+	var b strings.Builder
+	now := clock.Now()
+	for i, cp := range p.Certs {
+		if i != 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "certificate for the block at %s\n", cp.Block)
+		fmt.Fprintf(&b, "  domains: %s\n", strings.Join(cp.Domains, " "))
+		email := cp.Email
+		if email == "" {
+			email = "(no email)"
+		}
+		fmt.Fprintf(&b, "  account: %s at %s\n", email, cp.Server)
+		fmt.Fprintf(&b, "  challenge: %s\n", cp.Challenge)
+		fmt.Fprintf(&b, "  key type: %s\n", cp.KeyType)
+		switch {
+		case !cp.Exists:
+			b.WriteString("  status: not issued, will be issued\n")
+		case cp.Reissue:
+			fmt.Fprintf(&b, "  status: issued for other domains, expires at %s, will be reissued\n", cp.NotAfter.Format(time.RFC3339))
+		case !cp.RenewAt.After(now):
+			fmt.Fprintf(&b, "  status: issued, expires at %s, will be renewed\n", cp.NotAfter.Format(time.RFC3339))
+		default:
+			fmt.Fprintf(&b, "  status: issued, expires at %s, renews at %s\n", cp.NotAfter.Format(time.RFC3339), cp.RenewAt.Format(time.RFC3339))
+		}
+		for _, d := range cp.Deferred {
+			fmt.Fprintf(&b, "  deferred: %s\n", d)
+		}
+	}
+	if p.Diff != "" {
+		if len(p.Certs) != 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(p.Diff)
+	}
+	return b.String()
+}
+
+// ShowPlan parses the config given with -c, or Conf, and writes its plan
+// to stdout.
+func ShowPlan(args []string, stdout io.Writer) error {
+	fset := flag.NewFlagSet("nginxh plan", flag.ContinueOnError)
+	conf := fset.String("c", Conf, "the config `file`")
+	err := fset.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fset.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fset.Args(), " "))
+	}
+	tr, err := Parse(*conf, ConfDir)
+	if err != nil {
+		return err
+	}
+	plan, err := tr.Plan()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(stdout, plan.String())
+	return err
+}
@@ -0,0 +1,85 @@
+package nginx
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hgl/acmehugger/acme"
+)
+
+func TestPlan(t *testing.T) {
+	acme.AccountsDir = t.TempDir()
+	tr := parseText(t, `http {
+	acme_email test@example.com;
+	server {
+		listen 443 ssl;
+		server_name a.com;
+	}
+	server {
+		listen 80;
+		acme_defer listen 443 ssl;
+		server_name b.com;
+	}
+}
+`)
+	// a.com has a certificate
+	acct := &acme.Account{Email: "test@example.com"}
+	paths, err := acct.CertPaths("a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(acct.Dir()+"/certificates", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC)
+	crtData, err := selfSignedCert([]string{"a.com"}, notAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{paths.FullChain, paths.Chain, paths.Key} {
+		err = os.WriteFile(name, crtData, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan, err := tr.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Certs) != 2 {
+		t.Fatalf("got %d certificates, want 2", len(plan.Certs))
+	}
+	a, b := plan.Certs[0], plan.Certs[1]
+	if !slices.Equal(a.Domains, []string{"a.com"}) || !slices.Equal(b.Domains, []string{"b.com"}) {
+		t.Errorf("domains = %v and %v, want [a.com] and [b.com]", a.Domains, b.Domains)
+	}
+	if a.Email != "test@example.com" || a.Challenge != acme.ChallengeHTTP {
+		t.Errorf("email and challenge = %q and %v, want test@example.com and http", a.Email, a.Challenge)
+	}
+	if !a.Exists || a.Reissue || !a.NotAfter.Equal(notAfter) {
+		t.Errorf("certificate of a.com should exist and expire at %v", notAfter)
+	}
+	if want := notAfter.Add(-acme.DefaultDays * 24 * time.Hour); !a.RenewAt.Equal(want) {
+		t.Errorf("renew time = %v, want %v", a.RenewAt, want)
+	}
+	if len(a.Deferred) != 0 {
+		t.Errorf("a.com should have no deferred directives, got %q", a.Deferred)
+	}
+	if b.Exists {
+		t.Errorf("certificate of b.com should not exist")
+	}
+	if want := []string{"listen 443 ssl"}; !slices.Equal(b.Deferred, want) {
+		t.Errorf("deferred = %q, want %q", b.Deferred, want)
+	}
+	if !strings.Contains(plan.Diff, "+\t\tssl_certificate "+paths.FullChain+";\n") {
+		t.Errorf("diff should add ssl_certificate, got\n%s", plan.Diff)
+	}
+	if !strings.Contains(plan.Diff, "-\t\tacme_defer listen 443 ssl;\n") {
+		t.Errorf("diff should remove the deferred listen, got\n%s", plan.Diff)
+	}
+}
@@ -0,0 +1,258 @@
+package nginx
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Find returns the directives matching selector, in the order they appear in
+// the configs. Directives in included configs are treated as if they were in
+// place of the include directives.
+//
+// A selector is a list of steps separated by ">" to match children, or by
+// spaces to match descendants. The first step matches at any depth. A step
+// is a directive name, or "*" for any name, followed by any number of
+// filters:
+//
+//   - [name] matches a block containing the directive name.
+//   - [name=value] matches a block containing the directive name with the
+//     value as one of its values. The value can be quoted.
+//
+// For example, "http > server[server_name=example.com] location" finds all
+// locations in the http servers named example.com.
+func (tr *Tree) Find(selector string) ([]Directive, error) {
+	return find(tr.conf.Children, selector)
+}
+
+// Find is like Tree.Find, but finds directives in the block.
+func (d *BlockDirective) Find(selector string) ([]Directive, error) {
+	return find(d.Children, selector)
+}
+
+func find(children []Directive, selector string) ([]Directive, error) {
+	steps, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	var found []Directive
+	matchSteps(children, steps, &found)
+	return found, nil
+}
+
+type selectorStep struct {
+	name    string
+	filters []selectorFilter
+	// descendant is true if the step matches descendants of the previous
+	// step's directives, rather than only children.
+	descendant bool
+}
+
+type selectorFilter struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+func (s *selectorStep) matches(d Directive) bool {
+	if s.name != "*" && s.name != d.Name() {
+		return false
+	}
+	for _, f := range s.filters {
+		if !f.matches(d) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *selectorFilter) matches(d Directive) bool {
+	b, ok := d.(*BlockDirective)
+	if !ok {
+		return false
+	}
+	for _, child := range flattenIncludes(b.Children) {
+		if child.Name() != f.name {
+			continue
+		}
+		if !f.hasValue || slices.Contains(child.Args(), f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSteps(children []Directive, steps []*selectorStep, found *[]Directive) {
+	step := steps[0]
+	for _, d := range flattenIncludes(children) {
+		if step.matches(d) {
+			if len(steps) == 1 {
+				if !slices.Contains(*found, d) {
+					*found = append(*found, d)
+				}
+			} else if b, ok := d.(*BlockDirective); ok {
+				matchSteps(b.Children, steps[1:], found)
+			}
+		}
+		if step.descendant {
+			if b, ok := d.(*BlockDirective); ok {
+				matchSteps(b.Children, steps, found)
+			}
+		}
+	}
+}
+
+// flattenIncludes replaces include directives with the directives in the
+// included configs.
+func flattenIncludes(children []Directive) []Directive {
+	if !slices.ContainsFunc(children, func(d Directive) bool {
+		_, ok := d.(*IncludeDirective)
+		return ok
+	}) {
+		return children
+	}
+	var flat []Directive
+	for _, d := range children {
+		inc, ok := d.(*IncludeDirective)
+		if !ok {
+			flat = append(flat, d)
+			continue
+		}
+		for _, conf := range inc.Includes {
+			flat = append(flat, flattenIncludes(conf.Children)...)
+		}
+	}
+	return flat
+}
+
+func parseSelector(selector string) ([]*selectorStep, error) {
+	p := &selectorParser{s: selector}
+	var steps []*selectorStep
+	// The first step matches descendants of the starting point, like CSS.
+	descendant := true
+	for {
+		p.skipSpace()
+		if p.eof() {
+			break
+		}
+		if len(steps) != 0 {
+			if p.peek() == '>' {
+				p.i++
+				p.skipSpace()
+				descendant = false
+			} else if !unicode.IsSpace(rune(p.s[p.i-1])) {
+				return nil, p.errorf("expected > or space")
+			}
+		}
+		step, err := p.step()
+		if err != nil {
+			return nil, err
+		}
+		step.descendant = descendant
+		steps = append(steps, step)
+		descendant = true
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return steps, nil
+}
+
+type selectorParser struct {
+	s string
+	i int
+}
+
+func (p *selectorParser) eof() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *selectorParser) peek() byte {
+	return p.s[p.i]
+}
+
+func (p *selectorParser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(rune(p.peek())) {
+		p.i++
+	}
+}
+
+func (p *selectorParser) errorf(format string, a ...any) error {
+	return fmt.Errorf("invalid selector %q at %d: %s", p.s, p.i, fmt.Sprintf(format, a...))
+}
+
+func (p *selectorParser) step() (*selectorStep, error) {
+	name := p.name()
+	if name == "" {
+		return nil, p.errorf("expected a directive name or *")
+	}
+	step := &selectorStep{name: name}
+	for !p.eof() && p.peek() == '[' {
+		p.i++
+		f := selectorFilter{name: p.name()}
+		if f.name == "" || f.name == "*" {
+			return nil, p.errorf("expected a directive name")
+		}
+		if !p.eof() && p.peek() == '=' {
+			p.i++
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			f.value = value
+			f.hasValue = true
+		}
+		if p.eof() || p.peek() != ']' {
+			return nil, p.errorf("expected ]")
+		}
+		p.i++
+		step.filters = append(step.filters, f)
+	}
+	return step, nil
+}
+
+func (p *selectorParser) name() string {
+	if !p.eof() && p.peek() == '*' {
+		p.i++
+		return "*"
+	}
+	start := p.i
+	for !p.eof() && !strings.ContainsRune("[]=> \t\r\n\"'", rune(p.peek())) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func (p *selectorParser) value() (string, error) {
+	if p.eof() {
+		return "", p.errorf("expected a value")
+	}
+	q := p.peek()
+	if q != '"' && q != '\'' {
+		start := p.i
+		for !p.eof() && p.peek() != ']' {
+			p.i++
+		}
+		return p.s[start:p.i], nil
+	}
+	p.i++
+	var b strings.Builder
+	for !p.eof() {
+		c := p.peek()
+		p.i++
+		switch c {
+		case '\\':
+			if p.eof() {
+				return "", p.errorf("unterminated value")
+			}
+			b.WriteByte(p.peek())
+			p.i++
+		case q:
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated value")
+}
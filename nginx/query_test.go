@@ -0,0 +1,251 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+func TestFind(t *testing.T) {
+	tr := parseText(t, `http {
+	server {
+		server_name a.com;
+		location / {
+			location /nested {}
+		}
+	}
+	server {
+		server_name "b.com" c.com;
+		location /b {}
+	}
+}
+`)
+	tests := []struct {
+		selector string
+		want     []string
+	}{
+		{"location", []string{"/", "/nested", "/b"}},
+		{"http > server > location", []string{"/", "/b"}},
+		{"server[server_name=a.com] location", []string{"/", "/nested"}},
+		{`server[server_name="c.com"]>location`, []string{"/b"}},
+		{"* > location > *", []string{"/nested"}},
+		{"server[server_name=d.com]", nil},
+	}
+	for _, test := range tests {
+		found, err := tr.Find(test.selector)
+		if err != nil {
+			t.Errorf("Find(%q) failed: %v", test.selector, err)
+			continue
+		}
+		var got []string
+		for _, d := range found {
+			got = append(got, d.Args()...)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("Find(%q) = %v, want %v", test.selector, got, test.want)
+		}
+	}
+
+	for _, selector := range []string{"", "server >", "server[", "server[a=\"b]", "a[b]c"} {
+		_, err := tr.Find(selector)
+		if err == nil {
+			t.Errorf("Find(%q) should fail", selector)
+		}
+	}
+}
+
+func TestMutate(t *testing.T) {
+	tr := parseText(t, `http {
+	server {
+		listen 80; # plain
+		return 301 https://$host$request_uri;
+	}
+}
+`)
+	servers, err := tr.Find("http > server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := servers[0].(*BlockDirective)
+	ret := server.Children[1]
+	listen := server.Children[0]
+	// Moving a directive after one with a trailing comment must not comment
+	// it out.
+	ret.InsertBefore(NewDirective("server_name", []string{"a.com"}))
+	listen.InsertAfter(ret)
+	loc := NewBlockDirective("location", []string{"/"})
+	server.Append(loc)
+	loc.Append(NewDirective("root", []string{"/www"}))
+	if loc.Parent() != server || loc.ParentBlock() != server || loc.Config() != tr.Config() {
+		t.Errorf("appended block is not attached to the server")
+	}
+	root := loc.Children[0]
+	if root.Parent() != loc || root.ParentBlock() != loc || root.Config() != tr.Config() {
+		t.Errorf("appended directive is not attached to the location")
+	}
+	listen.ReplaceWith(NewDirective("listen", []string{"8080"}))
+
+	outDir := t.TempDir()
+	name, err := tr.Dump(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := util.ReadText(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `http {
+	server {
+		listen 8080;
+		return 301 https://$host$request_uri;
+		server_name a.com;
+		location / {
+			root /www;
+		}
+	}
+}
+`
+	if got != want {
+		t.Errorf("dumped\n%s\nwant\n%s", got, want)
+	}
+
+	tr = parseText(t, `http {
+	server {
+		listen 80; # plain
+	}
+	server { return 444; }
+}
+`)
+	servers, err = tr.Find("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret = servers[1].(*BlockDirective).Children[0]
+	servers[0].(*BlockDirective).Children[0].InsertAfter(ret)
+	name, err = tr.Dump(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Parse(name, filepath.Dir(name))
+	if err != nil {
+		t.Fatalf("dumped config is invalid: %v", err)
+	}
+	got, err = util.ReadText(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `http {
+	server {
+		listen 80; # plain
+		return 444;
+	}
+	server { }
+}
+`
+	if got != want {
+		t.Errorf("dumped\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMoveDepth(t *testing.T) {
+	tr := parseText(t, `http {
+    server {
+        listen 80;
+
+        # static files
+        location /static/ {
+            root /www;
+        }
+    }
+    # compress
+    gzip on;
+}
+`)
+	servers, err := tr.Find("http > server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := servers[0].(*BlockDirective)
+	http := server.ParentBlock()
+	// moved out to a shallower depth
+	loc := server.Children[1]
+	server.InsertAfter(loc)
+	// moved in to a deeper depth
+	gzip := http.Children[2]
+	server.Children[0].InsertAfter(gzip)
+	name, err := tr.Dump(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := util.ReadText(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `http {
+    server {
+        listen 80;
+        # compress
+        gzip on;
+    }
+
+    # static files
+    location /static/ {
+        root /www;
+    }
+}
+`
+	if got != want {
+		t.Errorf("dumped\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMoveInclude(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "server.conf"), []byte("listen 80;\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "nginx.conf")
+	err = os.WriteFile(name, []byte(`http {
+	server {
+		include server.conf;
+	}
+	server {
+		listen 81;
+	}
+}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Parse(name, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := tr.Find("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := servers[0].(*BlockDirective)
+	inc := server.Children[0]
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("moving an include directive to another block should panic")
+			}
+		}()
+		servers[1].(*BlockDirective).Append(inc)
+	}()
+	if inc.Parent() != server || len(server.Children) != 1 {
+		t.Errorf("include directive should stay in its block")
+	}
+	// moving within the block is fine
+	server.Append(NewDirective("root", []string{"/www"}))
+	server.Append(inc)
+	if server.Children[1] != inc {
+		t.Errorf("include directive should be moved to the end of its block")
+	}
+}
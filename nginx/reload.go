@@ -0,0 +1,109 @@
+package nginx
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/hgl/acmehugger/acme"
+	"github.com/hgl/acmehugger/internal/clock"
+)
+
+// ReloadWindow is how long nginx waits without new changes before it's
+// reloaded, so that certificates issued around the same time cause a single
+// reload. Start sets it from the environment variable
+// ACMEHUGGER_RELOAD_WINDOW.
+var ReloadWindow = 2 * time.Second
+
+// ReloadMaxDelay caps how long changes are collected, so that nginx is
+// still reloaded while changes keep coming.
+var ReloadMaxDelay = 30 * time.Second
+
+// reloadBatch coalesces ACME changes. Each change of a batch restarts a
+// window of the given length, up to a maximum delay after the first one.
+// When the window ends, nginx is reloaded once for all changes in the batch,
+// and hooks are called for each of them.
+type reloadBatch struct {
+	window   time.Duration
+	maxDelay time.Duration
+	reload   func(tr *Tree) error
+	hook     func(info *acme.HookInfo) error
+	infos    []*ACMEChangeInfo
+	timer    clock.Timer
+	// deadline is when the batch ends at the latest
+	deadline time.Time
+}
+
+func newReloadBatch(window time.Duration, maxDelay time.Duration, reload func(tr *Tree) error, hook func(info *acme.HookInfo) error) *reloadBatch {
+	return &reloadBatch{
+		window:   window,
+		maxDelay: maxDelay,
+		reload:   reload,
+		hook:     hook,
+	}
+}
+
+func (b *reloadBatch) add(info *ACMEChangeInfo) {
+	b.infos = append(b.infos, info)
+	now := clock.Now()
+	if b.timer == nil {
+		b.deadline = now.Add(b.maxDelay)
+	} else {
+		b.timer.Stop()
+	}
+	b.timer = clock.NewTimer(min(b.window, b.deadline.Sub(now)))
+}
+
+// C returns a channel that receives when the window ends. It's nil when
+// there is no change collected.
+func (b *reloadBatch) C() <-chan time.Time {
+	if b.timer == nil {
+		return nil
+	}
+	return b.timer.C()
+}
+
+// flush reloads nginx if any change needs it, and calls hooks.
+func (b *reloadBatch) flush() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	infos := b.infos
+	b.infos = nil
+	if len(infos) == 0 {
+		return
+	}
+
+	var tr *Tree
+	needReload := false
+	for _, info := range infos {
+		if info.Block.name != "server" {
+			continue
+		}
+		needReload = true
+		if info.TreeChanged {
+			tr = info.Block.Tree()
+		}
+	}
+	var reloadErr string
+	if needReload {
+		err := b.reload(tr)
+		if err != nil {
+			slog.Error("failed to reload nginx", "error", err)
+			reloadErr = err.Error()
+		} else {
+			slog.Debug("nginx reloaded for changes", "count", len(infos))
+		}
+	}
+	for _, info := range infos {
+		err := b.hook(&acme.HookInfo{
+			Server:      info.Server,
+			Email:       info.Email,
+			Domains:     info.Domains,
+			ReloadError: reloadErr,
+		})
+		if err != nil {
+			slog.Debug("failed to call hooks", "domains", info.Domains, "error", err)
+		}
+	}
+}
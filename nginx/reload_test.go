@@ -0,0 +1,111 @@
+package nginx
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hgl/acmehugger/acme"
+	"github.com/hgl/acmehugger/internal/clock"
+	"github.com/hgl/acmehugger/internal/clock/clocktest"
+)
+
+func TestReloadBatch(t *testing.T) {
+	origClock := clock.Default()
+	defer func() {
+		clock.SetDefault(origClock)
+	}()
+	fakeClock := clocktest.NewClock(time.Time{})
+	clock.SetDefault(fakeClock)
+
+	tr := parseText(t, `events {}
+http {
+	server {
+		listen 443 ssl;
+	}
+}
+acme {}
+`)
+	servers, err := tr.Find("http > server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acmes, err := tr.Find("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := servers[0].(*BlockDirective)
+	acmeBlock := acmes[0].(*BlockDirective)
+
+	var reloads []*Tree
+	var hooks []*acme.HookInfo
+	b := newReloadBatch(time.Second, 2*time.Second, func(tr *Tree) error {
+		reloads = append(reloads, tr)
+		return errors.New("rejected")
+	}, func(info *acme.HookInfo) error {
+		hooks = append(hooks, info)
+		return nil
+	})
+	if b.C() != nil {
+		t.Fatalf("window should not start without changes")
+	}
+	b.add(&ACMEChangeInfo{Block: server, TreeChanged: false, Domains: []string{"a"}})
+	b.add(&ACMEChangeInfo{Block: server, TreeChanged: true, Domains: []string{"b"}})
+	b.add(&ACMEChangeInfo{Block: acmeBlock, Domains: []string{"c"}})
+	fakeClock.Tick(time.Second / 2)
+	select {
+	case <-b.C():
+		t.Fatalf("window should not end early")
+	default:
+	}
+	// a new change restarts the window
+	b.add(&ACMEChangeInfo{Block: acmeBlock, Domains: []string{"d"}})
+	fakeClock.Tick(time.Second * 3 / 4)
+	select {
+	case <-b.C():
+		t.Fatalf("window should be restarted by new changes")
+	default:
+	}
+	fakeClock.Tick(time.Second / 2)
+	<-b.C()
+	b.flush()
+
+	if len(reloads) != 1 || reloads[0] != tr {
+		t.Errorf("reloads = %v, want a single reload with the tree", reloads)
+	}
+	var domains []string
+	for _, info := range hooks {
+		domains = append(domains, info.Domains...)
+		if info.ReloadError != "rejected" {
+			t.Errorf("hook reload error = %q, want %q", info.ReloadError, "rejected")
+		}
+	}
+	if want := []string{"a", "b", "c", "d"}; !slices.Equal(domains, want) {
+		t.Errorf("hooked domains = %v, want %v", domains, want)
+	}
+	if b.C() != nil {
+		t.Errorf("window should end after flushing")
+	}
+
+	// changes that keep coming are collected up to the maximum delay
+	for i := 0; i < 4; i++ {
+		b.add(&ACMEChangeInfo{Block: acmeBlock, Domains: []string{"e"}})
+		fakeClock.Tick(time.Second / 2)
+	}
+	fakeClock.Tick(time.Millisecond)
+	select {
+	case <-b.C():
+	default:
+		t.Fatalf("window should end at the maximum delay")
+	}
+	b.flush()
+
+	// changes to acme blocks alone don't reload
+	reloads = nil
+	b.add(&ACMEChangeInfo{Block: acmeBlock, Domains: []string{"c"}})
+	b.flush()
+	if len(reloads) != 0 {
+		t.Errorf("reloads = %v, want none", reloads)
+	}
+}
@@ -0,0 +1,354 @@
+package nginx
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hgl/acmehugger/acme"
+	"github.com/hgl/acmehugger/internal/clock"
+	"github.com/hgl/acmehugger/internal/sdnotify"
+)
+
+// ShutdownTimeout is how long to wait for certificate issuances in progress
+// to finish when shutting down.
+var ShutdownTimeout = 30 * time.Second
+
+// runner runs nginx with the generated config, and keeps the config up to
+// date with the certificates.
+type runner struct {
+	conf    string
+	bin     string
+	args    []string
+	tr      *Tree
+	inst    *Instance
+	ap      *ACMEProcessor
+	changed <-chan *ACMEChangeInfo
+	batch   *reloadBatch
+	watcher *confWatcher
+	// sidecar is true if nginx is not started by nginxh, and reloaded with
+	// reloadCmd if it's not empty.
+	sidecar   bool
+	reloadCmd string
+	// supervise is true if nginx is restarted after exiting unexpectedly
+	supervise bool
+	restarts  restartPolicy
+	// restartTimer is not nil while nginx is waiting to be restarted
+	restartTimer clock.Timer
+	// ready, if not nil, is called with the result of starting nginx
+	ready func(err error)
+	// writePid is true if PidFile is written once nginx is started, and
+	// removed when the runner stops
+	writePid bool
+	// metrics is nil unless metrics are served
+	metrics *Metrics
+	// paused is true if issuing and renewing certificates is paused
+	paused bool
+	// controlC receives functions to be run in the runner's goroutine
+	controlC chan func()
+	// stopped is closed once the runner stops running
+	stopped chan struct{}
+	// renderErr is the error of the last render
+	renderErr error
+	// exited receives the result of waiting for nginx
+	exited chan error
+	// acmeWG tracks stopped ACME processors whose issuances are in progress
+	acmeWG sync.WaitGroup
+}
+
+func newRunner(conf string, bin string, args []string, watcher *confWatcher) *runner {
+	r := &runner{
+		conf:     conf,
+		bin:      bin,
+		args:     args,
+		watcher:  watcher,
+		exited:   make(chan error, 1),
+		controlC: make(chan func()),
+		stopped:  make(chan struct{}),
+	}
+	r.batch = newReloadBatch(ReloadWindow, ReloadMaxDelay, func(tr *Tree) error {
+		r.notify(sdnotify.Reloading())
+		err := r.inst.Reload(tr)
+		r.notify(sdnotify.Ready)
+		return err
+	}, func(info *acme.HookInfo) error {
+		return acme.RunHooks(info, r.metrics.hookRan)
+	})
+	return r
+}
+
+func (r *runner) run() error {
+	defer close(r.stopped)
+	if r.writePid {
+		defer removePidFile()
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	// signal.Notify relays all signals when none is given
+	fwd := make(chan os.Signal, 1)
+	if len(forwardedSignals) != 0 && !r.sidecar {
+		signal.Notify(fwd, forwardedSignals...)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, stopSignals...)
+	defer signal.Stop(hup)
+	defer signal.Stop(fwd)
+	defer signal.Stop(stop)
+	// watchC stays nil unless watching is enabled, so it never receives
+	var watchC chan struct{}
+	if r.watcher != nil {
+		watchC = r.watcher.C
+	}
+	var watchdogC <-chan time.Time
+	if interval := sdnotify.WatchdogInterval(); interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		watchdogC = t.C
+	}
+
+	err := r.render()
+	if r.ready != nil {
+		r.ready(err)
+		if err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		slog.Error("failed to reload config", "error", err)
+	} else {
+		r.notify(sdnotify.Ready)
+	}
+	for {
+		select {
+		case <-r.statusChanged():
+			r.notify()
+		case <-watchdogC:
+			r.notify(sdnotify.Watchdog)
+		case fn := <-r.controlC:
+			fn()
+		case info := <-r.changed:
+			r.batch.add(info)
+		case <-r.batch.C():
+			r.batch.flush()
+		case <-hup:
+			slog.Debug("SIGHUP received, reloading config")
+			r.rerender()
+		case <-watchC:
+			slog.Debug("config files changed, reloading config")
+			r.rerender()
+		case sig := <-fwd:
+			if r.inst == nil {
+				continue
+			}
+			slog.Debug("signal forwarded to nginx", "signal", sig)
+			err := r.inst.Signal(sig)
+			if err != nil {
+				slog.Error("failed to forward signal to nginx", "signal", sig, "error", err)
+			}
+		case sig := <-stop:
+			return r.shutdown(sig)
+		case err := <-r.exited:
+			if r.scheduleRestart(err) {
+				continue
+			}
+			r.stopACME()
+			r.waitACME()
+			if r.inst.Daemon() {
+				// it's stopped outside nginxh, like by an init script
+				slog.Info("nginx exited")
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("nginx exited unexpectedly: %w", err)
+			}
+			return errors.New("nginx exited unexpectedly")
+		case <-r.restartC():
+			r.restartTimer = nil
+			err := r.inst.Restart()
+			if err != nil {
+				r.exited <- err
+				continue
+			}
+			r.wait()
+		}
+	}
+}
+
+// scheduleRestart schedules restarting nginx if it's supervised and hasn't
+// exited too often, and reports whether it did so.
+func (r *runner) scheduleRestart(err error) bool {
+	if !r.supervise || r.inst.Daemon() {
+		return false
+	}
+	delay, ok := r.restarts.exited(clock.Now())
+	if !ok {
+		slog.Error("nginx keeps exiting, giving up restarting it", "limit", CrashLoopLimit, "window", CrashLoopWindow)
+		return false
+	}
+	slog.Error("nginx exited unexpectedly, restarting", "error", err, "delay", delay)
+	r.restartTimer = clock.NewTimer(delay)
+	return true
+}
+
+func (r *runner) restartC() <-chan time.Time {
+	if r.restartTimer == nil {
+		return nil
+	}
+	return r.restartTimer.C()
+}
+
+// wait sends the result of waiting for nginx to r.exited.
+func (r *runner) wait() {
+	inst := r.inst
+	go func() {
+		r.exited <- inst.Wait()
+	}()
+}
+
+// render parses the configs, starts nginx with the generated config or
+// reloads it, and starts issuing certificates.
+func (r *runner) render() (err error) {
+	defer func() {
+		r.renderErr = err
+	}()
+	if r.tr == nil {
+		r.tr, err = Parse(r.conf, ConfDir)
+	} else {
+		err = r.tr.Parse()
+	}
+	if r.watcher != nil {
+		r.watcher.watch(r.conf, r.tr)
+	}
+	if err != nil {
+		return err
+	}
+	ap, err := r.tr.PrepareACME()
+	if err != nil {
+		return err
+	}
+	if r.inst == nil && r.sidecar {
+		inst, err := AttachInstance(r.tr, r.bin, r.args, r.reloadCmd, r.metrics)
+		if err != nil {
+			return err
+		}
+		r.inst = inst
+		r.started()
+	} else if r.inst == nil {
+		inst, err := StartInstance(r.tr, r.bin, r.args, r.metrics)
+		if err != nil {
+			return err
+		}
+		r.inst = inst
+		r.wait()
+		r.started()
+	} else {
+		err = r.inst.Reload(r.tr)
+		if err != nil {
+			return err
+		}
+	}
+	r.metrics.resetCerts()
+	ap.SetMetrics(r.metrics)
+	if r.paused {
+		ap.Pause()
+	}
+	r.ap = ap
+	r.changed = ap.Process()
+	return nil
+}
+
+// started is called once nginx is started, or attached to.
+func (r *runner) started() {
+	if !r.writePid {
+		return
+	}
+	err := writePidFile()
+	if err != nil {
+		slog.Error("failed to write PID file", "error", err)
+	}
+}
+
+func (r *runner) rerender() {
+	r.batch.flush()
+	r.stopACME()
+	r.notify(sdnotify.Reloading())
+	err := r.render()
+	if err != nil {
+		slog.Error("failed to reload config", "error", err)
+	}
+	if r.inst != nil {
+		r.notify(sdnotify.Ready)
+	}
+}
+
+func (r *runner) statusChanged() <-chan struct{} {
+	if r.ap == nil {
+		return nil
+	}
+	return r.ap.StatusChanged()
+}
+
+func (r *runner) stopACME() {
+	if r.ap == nil {
+		return
+	}
+	r.ap.Stop()
+	changed := r.changed
+	r.acmeWG.Add(1)
+	go func() {
+		defer r.acmeWG.Done()
+		// changed is closed once issuances in progress finish
+		for range changed {
+		}
+	}()
+	r.ap = nil
+	r.changed = nil
+}
+
+func (r *runner) waitACME() {
+	done := make(chan struct{})
+	go func() {
+		r.acmeWG.Wait()
+		close(done)
+	}()
+	t := clock.NewTimer(ShutdownTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C():
+		slog.Error("timed out waiting for certificate issuances to finish")
+	}
+}
+
+// shutdown passes sig to nginx, waits for it to exit, and returns its
+// result. A sidecar nginx is left running.
+func (r *runner) shutdown(sig os.Signal) error {
+	slog.Debug("shutting down", "signal", sig)
+	r.notify(sdnotify.Stopping)
+	r.batch.flush()
+	r.stopACME()
+	if r.inst == nil || r.inst.Sidecar() {
+		r.waitACME()
+		return nil
+	}
+	if r.restartTimer != nil {
+		// nginx is not running
+		r.restartTimer.Stop()
+		r.restartTimer = nil
+		r.waitACME()
+		return nil
+	}
+	err := r.inst.Signal(sig)
+	if err != nil {
+		slog.Error("failed to signal nginx, killing it", "signal", sig, "error", err)
+		r.inst.Kill()
+	}
+	err = <-r.exited
+	r.waitACME()
+	return err
+}
@@ -0,0 +1,81 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+func TestRunnerShutdown(t *testing.T) {
+	// exits with 3 on SIGQUIT, and is killed by other signals
+	bin, conf := writeNginx(t, `trap 'exit 3' QUIT
+touch "$0.ready"
+while :; do
+	sleep 0.05
+done
+`, `daemon off;
+events {}
+http {
+	server {
+		listen 80;
+	}
+}
+`)
+	dir := filepath.Dir(bin)
+	PidFile = filepath.Join(dir, "nginxh.pid")
+
+	// the PID file is written once nginx is started
+	r := newRunner(conf, filepath.Join(dir, "missing"), nil, nil)
+	r.writePid = true
+	err := r.render()
+	if err == nil {
+		t.Fatal("starting a missing nginx should fail")
+	}
+	exist, err := util.FileExist(PidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exist {
+		t.Errorf("PID file should not be written if nginx fails to start")
+	}
+
+	tests := []struct {
+		sig  syscall.Signal
+		code int
+	}{
+		{syscall.SIGQUIT, 3},
+		{syscall.SIGTERM, 128 + int(syscall.SIGTERM)},
+	}
+	for _, tt := range tests {
+		r := newRunner(conf, bin, nil, nil)
+		r.writePid = true
+		err := r.render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pid, err := readPidFile(PidFile, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pid != os.Getpid() {
+			t.Errorf("PID file = %d, want %d", pid, os.Getpid())
+		}
+		// wait for the trap to be set
+		for {
+			if _, err := os.Stat(bin + ".ready"); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		os.Remove(bin + ".ready")
+		err = r.shutdown(tt.sig)
+		if code := ExitCode(err); code != tt.code {
+			t.Errorf("exit code after %v = %d, want %d", tt.sig, code, tt.code)
+		}
+		removePidFile()
+	}
+}
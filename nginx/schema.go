@@ -0,0 +1,272 @@
+package nginx
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hgl/acmehugger/acme"
+	"github.com/hgl/acmehugger/internal/stack"
+)
+
+type context int
+
+const (
+	contextMain context = 1 << iota
+	contextHTTP
+	contextStream
+	contextMail
+	contextServer
+	contextACME
+	contextOther
+)
+
+const contextAnyACME = contextMain | contextHTTP | contextStream | contextMail | contextServer | contextACME
+
+var contextNames = []string{"main", "http", "stream", "mail", "server", "acme"}
+
+func (c context) String() string {
+	var names []string
+	for i, name := range contextNames {
+		if c&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+type directiveSchema struct {
+	contexts context
+	block    bool
+	unique   bool
+	minArgs  int
+	// maxArgs is -1 if unlimited
+	maxArgs int
+	check   func(args []string) error
+}
+
+var acmeSchemas = map[string]*directiveSchema{
+	"acme": {
+		contexts: contextMain,
+		block:    true,
+	},
+	"acme_email": {
+		contexts: contextAnyACME,
+		unique:   true,
+		minArgs:  1,
+		maxArgs:  1,
+	},
+	"acme_server": {
+		contexts: contextAnyACME,
+		unique:   true,
+		minArgs:  1,
+		maxArgs:  1,
+	},
+	"acme_staging": {
+		contexts: contextAnyACME,
+		unique:   true,
+		minArgs:  1,
+		maxArgs:  1,
+		check:    checkBoolArg,
+	},
+	"acme_challenge": {
+		contexts: contextAnyACME,
+		unique:   true,
+		minArgs:  1,
+		maxArgs:  1,
+		check: func(args []string) error {
+			_, err := acme.ParseChallengeType(args[0])
+			return err
+		},
+	},
+	"acme_days": {
+		contexts: contextAnyACME,
+		unique:   true,
+		minArgs:  1,
+		maxArgs:  1,
+		check: func(args []string) error {
+			_, err := strconv.Atoi(args[0])
+			if err != nil {
+				return errors.New("must be a number")
+			}
+			return nil
+		},
+	},
+	"acme_key": {
+		contexts: contextAnyACME,
+		unique:   true,
+		minArgs:  1,
+		maxArgs:  1,
+		check: func(args []string) error {
+			_, err := acme.ParseKeyType(args[0])
+			return err
+		},
+	},
+	"acme_dns": {
+		contexts: contextAnyACME,
+		unique:   true,
+		minArgs:  1,
+		maxArgs:  1,
+	},
+	"acme_dns_option": {
+		contexts: contextAnyACME,
+		minArgs:  2,
+		maxArgs:  2,
+	},
+	"acme_domain": {
+		contexts: contextServer | contextACME,
+		unique:   true,
+		minArgs:  1,
+		maxArgs:  -1,
+	},
+	"acme_defer": {
+		contexts: contextServer,
+		minArgs:  1,
+		maxArgs:  -1,
+	},
+	"acme_output_pem": {
+		contexts: contextAnyACME,
+		minArgs:  1,
+		maxArgs:  -1,
+		check:    checkOutputArgs(acme.OutputPEM),
+	},
+	"acme_output_pkcs12": {
+		contexts: contextAnyACME,
+		minArgs:  1,
+		maxArgs:  -1,
+		check:    checkOutputArgs(acme.OutputPKCS12),
+	},
+	"acme_output_copy": {
+		contexts: contextAnyACME,
+		minArgs:  2,
+		maxArgs:  -1,
+		check: func(args []string) error {
+			t, err := acme.ParseOutputCopyType(args[0])
+			if err != nil {
+				return err
+			}
+			return checkOutputArgs(t)(args[1:])
+		},
+	},
+}
+
+func checkBoolArg(args []string) error {
+	switch args[0] {
+	case "on", "off":
+		return nil
+	default:
+		return errors.New("must be either on or off")
+	}
+}
+
+func checkOutputArgs(t acme.OutputType) func(args []string) error {
+	return func(args []string) error {
+		o := &acme.Output{Type: t}
+		return o.ParseParams(args[1:])
+	}
+}
+
+func (s *directiveSchema) validate(d Directive, ctx context) error {
+	name := d.Name()
+	if s.contexts&ctx == 0 {
+		return fmt.Errorf("%s is not allowed here (allowed in: %s) in %s", name, s.contexts, d.Location())
+	}
+	_, isBlock := d.(*BlockDirective)
+	if s.block && !isBlock {
+		return fmt.Errorf("%s must be a block in %s", name, d.Location())
+	}
+	if !s.block && isBlock {
+		return fmt.Errorf("%s must not be a block in %s", name, d.Location())
+	}
+	n := len(d.Args())
+	switch {
+	case n < s.minArgs || (s.maxArgs != -1 && n > s.maxArgs):
+		var want string
+		switch {
+		case s.maxArgs == -1:
+			want = fmt.Sprintf("at least %d", s.minArgs)
+		case s.minArgs == s.maxArgs:
+			want = strconv.Itoa(s.minArgs)
+		default:
+			want = fmt.Sprintf("%d to %d", s.minArgs, s.maxArgs)
+		}
+		return fmt.Errorf("%s requires %s value(s), got %d in %s", name, want, n, d.Location())
+	case s.check != nil:
+		err := s.check(d.Args())
+		if err != nil {
+			return fmt.Errorf("%s: %w in %s", name, err, d.Location())
+		}
+	}
+	return nil
+}
+
+// validateACME checks every acme directive in the tree against its schema,
+// and reports all violations.
+func (tr *Tree) validateACME() error {
+	v := &acmeValidator{}
+	err := tr.Accept(v)
+	if err != nil {
+		return err
+	}
+	return errors.Join(v.errs...)
+}
+
+type acmeValidator struct {
+	NoopVisitor
+	ctxStack  stack.Stack[context]
+	seenStack stack.Stack[map[string]Directive]
+	errs      []error
+}
+
+func (v *acmeValidator) VisitTreeBegin(*Tree) error {
+	v.ctxStack = stack.Stack[context]{contextMain}
+	v.seenStack = stack.Stack[map[string]Directive]{make(map[string]Directive)}
+	return nil
+}
+
+func (v *acmeValidator) VisitBlockBegin(d *BlockDirective) error {
+	ctx := contextOther
+	switch parent := v.ctxStack.MustPeek(); {
+	case parent == contextMain && d.Name() == "http":
+		ctx = contextHTTP
+	case parent == contextMain && d.Name() == "stream":
+		ctx = contextStream
+	case parent == contextMain && d.Name() == "mail":
+		ctx = contextMail
+	case parent == contextMain && d.Name() == "acme":
+		ctx = contextACME
+	case parent&(contextHTTP|contextStream|contextMail) != 0 && d.Name() == "server":
+		ctx = contextServer
+	}
+	v.ctxStack.Push(ctx)
+	v.seenStack.Push(make(map[string]Directive))
+	return nil
+}
+
+func (v *acmeValidator) VisitBlockEnd(*BlockDirective) error {
+	v.ctxStack.MustPop()
+	v.seenStack.MustPop()
+	return nil
+}
+
+func (v *acmeValidator) VisitDirective(d Directive) error {
+	s, ok := acmeSchemas[d.Name()]
+	if !ok {
+		return nil
+	}
+	err := s.validate(d, v.ctxStack.MustPeek())
+	if err != nil {
+		v.errs = append(v.errs, err)
+		return nil
+	}
+	if s.unique {
+		seen := v.seenStack.MustPeek()
+		if first, ok := seen[d.Name()]; ok {
+			v.errs = append(v.errs, fmt.Errorf("%s is duplicate (first defined in %s) in %s", d.Name(), first.Location(), d.Location()))
+			return nil
+		}
+		seen[d.Name()] = d
+	}
+	return nil
+}
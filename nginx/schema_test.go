@@ -0,0 +1,49 @@
+package nginx
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateACME(t *testing.T) {
+	src, err := filepath.Abs("testdata/validate/invalid.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Parse(src, filepath.Dir(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.validateACME()
+	if err == nil {
+		t.Fatal("invalid config passed validation")
+	}
+	want := []string{
+		"acme_email is duplicate (first defined in %[1]s:1:1) in %[1]s:2:1",
+		"acme_domain is not allowed here (allowed in: server, acme) in %[1]s:3:1",
+		"acme_domain is not allowed here (allowed in: server, acme) in %[1]s:5:2",
+		"acme_staging: must be either on or off in %[1]s:6:2",
+		"acme_key: invalid key type: rsa1 in %[1]s:9:3",
+		"acme_days requires 1 value(s), got 0 in %[1]s:10:3",
+		"acme_email is not allowed here (allowed in: main, http, stream, mail, server, acme) in %[1]s:12:4",
+		"acme_defer is not allowed here (allowed in: server) in %[1]s:17:2",
+		"acme_output_copy: invalid output copy type: cert in %[1]s:18:2",
+		"acme_email must not be a block in %[1]s:22:1",
+	}
+	got := strings.Split(err.Error(), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%s", len(got), len(want), err)
+	}
+	for i, w := range want {
+		w = strings.ReplaceAll(w, "%[1]s", src)
+		if got[i] != w {
+			t.Errorf("error %d = %s, want %s", i, got[i], w)
+		}
+	}
+
+	_, err = tr.PrepareACME()
+	if err == nil {
+		t.Fatal("PrepareACME should fail on invalid config")
+	}
+}
@@ -0,0 +1,105 @@
+package nginx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// AttachInstance dumps the tree for an nginx that nginxh doesn't start, like
+// one running in another container sharing ConfOutDir, which should be
+// started with the config returned by Instance.Conf. The nginx is reloaded
+// by running reloadCmd with sh if it's not empty, or else by signaling the
+// master process in the PID file. Reloads are recorded in m if it's not nil.
+func AttachInstance(tr *Tree, bin string, args []string, reloadCmd string, m *Metrics) (*Instance, error) {
+	proc := &sidecarProcess{reloadCmd: reloadCmd}
+	if reloadCmd == "" {
+		var err error
+		proc.pidFile, err = pidFile(tr, bin, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	versions := NewConfVersions(ConfOutDir, ConfKeepVersions)
+	name, err := versions.Dump(tr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("config generated for nginx", "conf", name)
+	inst := &Instance{
+		proc:     proc,
+		bin:      bin,
+		args:     args,
+		tr:       tr,
+		versions: versions,
+		sidecar:  true,
+		metrics:  m,
+	}
+	// nginx may be running with a config generated before
+	err = inst.Reload(nil)
+	if err != nil {
+		slog.Info("failed to reload nginx, it may not have started", "error", err)
+	}
+	return inst, nil
+}
+
+// Conf returns the path of the generated entry config.
+func (inst *Instance) Conf() string {
+	return inst.versions.CurrentConf(inst.tr)
+}
+
+// sidecarProcess is an nginx that nginxh doesn't start. Its master process
+// is looked up each time it's signaled, since nginx may have restarted.
+type sidecarProcess struct {
+	pidFile   string
+	reloadCmd string
+}
+
+// Pid returns the PID in the PID file, or 0 if it's unknown.
+func (p *sidecarProcess) Pid() int {
+	if p.pidFile == "" {
+		return 0
+	}
+	pid, err := readPidFile(p.pidFile, time.Time{})
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+func (p *sidecarProcess) Signal(sig os.Signal) error {
+	if sig == syscall.SIGHUP && p.reloadCmd != "" {
+		cmd := exec.Command("sh", "-c", p.reloadCmd)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("reload command failed: %w: %s", err, strings.TrimSpace(out.String()))
+		}
+		return nil
+	}
+	if p.pidFile == "" {
+		return errors.New("no PID file to find nginx")
+	}
+	pid, err := readPidFile(p.pidFile, time.Time{})
+	if err != nil {
+		return err
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(sig)
+}
+
+// Wait never returns, nginx restarting is not nginxh's concern.
+func (p *sidecarProcess) Wait() error {
+	select {}
+}
@@ -0,0 +1,92 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+func TestSidecarReloadCommand(t *testing.T) {
+	dir := t.TempDir()
+	ConfOutDir = t.TempDir()
+	log := filepath.Join(dir, "log")
+	tr := parseText(t, "events {}\n")
+	m := NewMetrics()
+	inst, err := AttachInstance(tr, filepath.Join(dir, "nginx"), nil, fmt.Sprintf("echo reloaded >> %s", log), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exist, err := util.FileExist(inst.Conf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist {
+		t.Errorf("config should be generated")
+	}
+	err = inst.Reload(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := util.ReadText(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// once when attached, once when reloaded
+	if want := "reloaded\nreloaded\n"; got != want {
+		t.Errorf("reload command output = %q, want %q", got, want)
+	}
+
+	err = inst.Reload(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst.proc.(*sidecarProcess).reloadCmd = "echo failed; exit 1"
+	err = inst.Reload(nil)
+	if err == nil {
+		t.Errorf("failed reload command should return an error")
+	}
+	var b strings.Builder
+	err = m.reg.WriteText(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// including the reload when attached
+	if want := `acmehugger_nginx_reloads_total{result="success"} 3` + "\n"; !strings.Contains(b.String(), want) {
+		t.Errorf("metrics should contain %q, got\n%s", want, b.String())
+	}
+}
+
+func TestSidecarPidFile(t *testing.T) {
+	dir := t.TempDir()
+	ConfOutDir = t.TempDir()
+	cmd := exec.Command("sleep", "60")
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidName := filepath.Join(dir, "nginx.pid")
+	err = os.WriteFile(pidName, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := parseText(t, fmt.Sprintf("pid %s;\nevents {}\n", pidName))
+	// the attached process is signaled with SIGHUP, which kills sleep
+	inst, err := AttachInstance(tr, filepath.Join(dir, "nginx"), nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Pid() != cmd.Process.Pid {
+		t.Errorf("pid = %d, want %d", inst.Pid(), cmd.Process.Pid)
+	}
+	err = cmd.Wait()
+	if code := ExitCode(err); code != 128+int(syscall.SIGHUP) {
+		t.Errorf("exit code = %d, process should be killed by SIGHUP", code)
+	}
+}
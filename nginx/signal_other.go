@@ -0,0 +1,11 @@
+//go:build !unix
+
+package nginx
+
+import "os"
+
+var forwardedSignals []os.Signal
+
+var stopSignals = []os.Signal{os.Interrupt}
+
+var signalNames map[string]os.Signal
@@ -0,0 +1,26 @@
+//go:build unix
+
+package nginx
+
+import (
+	"os"
+	"syscall"
+)
+
+// forwardedSignals are passed to nginx as is: reopening log files and
+// upgrading the binary.
+var forwardedSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH}
+
+// stopSignals are passed to nginx, and then nginxh exits along with it.
+// SIGQUIT makes nginx shut down gracefully, the others make it shut down
+// fast.
+var stopSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT}
+
+// signalNames map the arguments of the -s option to the signals nginxh
+// handles, like nginx does.
+var signalNames = map[string]os.Signal{
+	"stop":   syscall.SIGTERM,
+	"quit":   syscall.SIGQUIT,
+	"reopen": syscall.SIGUSR1,
+	"reload": syscall.SIGHUP,
+}
@@ -0,0 +1,252 @@
+package nginx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SourceLine is the origin of a line in a dumped config.
+type SourceLine struct {
+	File   string
+	Line   int
+	Column int
+	// Synthesized is true if the line was added by acmehugger, in which case
+	// File, Line and Column point to the closest enclosing block written by
+	// the user, or only File is set if there is none.
+	Synthesized bool
+}
+
+func (l SourceLine) String() string {
+	if l.Line == 0 {
+		return l.File
+	}
+	return fmt.Sprintf("%s:%d:%d", l.File, l.Line, l.Column)
+}
+
+// SourceMap maps lines in dumped configs back to the configs they are dumped
+// from.
+type SourceMap struct {
+	files map[string][]SourceLine
+	// links maps directories to the directories they are symlinked to.
+	links map[string]string
+	mu    sync.RWMutex
+}
+
+func (m *SourceMap) add(files map[string][]SourceLine) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = make(map[string][]SourceLine)
+	}
+	for name, lines := range files {
+		m.files[name] = lines
+	}
+}
+
+// forget removes the configs dumped in dir.
+func (m *SourceMap) forget(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name := range m.files {
+		if strings.HasPrefix(name, dir+string(filepath.Separator)) {
+			delete(m.files, name)
+		}
+	}
+}
+
+// link makes configs dumped in target also found through dir.
+func (m *SourceMap) link(dir string, target string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.links == nil {
+		m.links = make(map[string]string)
+	}
+	m.links[dir] = target
+}
+
+// Lookup returns the origin of the 1-based line in the dumped config name.
+func (m *SourceMap) Lookup(name string, line int) (SourceLine, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	lines, ok := m.files[name]
+	if !ok {
+		for dir, target := range m.links {
+			rest, found := strings.CutPrefix(name, dir+string(filepath.Separator))
+			if found {
+				lines, ok = m.files[filepath.Join(target, rest)]
+				break
+			}
+		}
+	}
+	if !ok || line < 1 || line > len(lines) {
+		return SourceLine{}, false
+	}
+	return lines[line-1], true
+}
+
+var nginxErrLocRegexp = regexp.MustCompile(` in (\S+):(\d+)`)
+
+// Rewrite rewrites the "in file:line" locations in nginx's error messages
+// to point to the original configs.
+func (m *SourceMap) Rewrite(msg string) string {
+	return nginxErrLocRegexp.ReplaceAllStringFunc(msg, func(s string) string {
+		match := nginxErrLocRegexp.FindStringSubmatch(s)
+		line, err := strconv.Atoi(match[2])
+		if err != nil {
+			return s
+		}
+		src, ok := m.Lookup(match[1], line)
+		if !ok {
+			return s
+		}
+		if src.Synthesized {
+			if src.Line == 0 {
+				return fmt.Sprintf("%s (synthesized by acmehugger in %s)", s, src.File)
+			}
+			return fmt.Sprintf("%s (synthesized by acmehugger in the block at %s:%d)", s, src.File, src.Line)
+		}
+		return fmt.Sprintf(" in %s:%d", src.File, src.Line)
+	})
+}
+
+// Writer returns a writer that rewrites each line written to it with
+// Rewrite before writing it to w. Closing it writes the last line if it
+// doesn't end with a newline.
+func (m *SourceMap) Writer(w io.Writer) io.WriteCloser {
+	return &sourceMapWriter{m: m, w: w}
+}
+
+type sourceMapWriter struct {
+	m   *SourceMap
+	w   io.Writer
+	buf []byte
+	mu  sync.Mutex
+}
+
+func (w *sourceMapWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		line := w.m.Rewrite(string(w.buf[:i+1]))
+		w.buf = w.buf[i+1:]
+		_, err := io.WriteString(w.w, line)
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func (w *sourceMapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := w.m.Rewrite(string(w.buf))
+	w.buf = nil
+	_, err := io.WriteString(w.w, line)
+	return err
+}
+
+func (tr *Tree) SourceMap() *SourceMap {
+	return &tr.srcMap
+}
+
+// lineOrigin is the origin of text being dumped. pos advances with the text
+// unless fixed is true.
+type lineOrigin struct {
+	conf        *Config
+	pos         pos
+	fixed       bool
+	synthesized bool
+}
+
+func (o lineOrigin) advance(n int) lineOrigin {
+	if !o.fixed && !o.synthesized && o.pos != -1 {
+		o.pos += pos(n)
+	}
+	return o
+}
+
+func (o lineOrigin) sourceLine() SourceLine {
+	l := SourceLine{
+		File:        o.conf.path,
+		Synthesized: o.synthesized,
+	}
+	if o.pos != -1 {
+		l.Line, l.Column = o.conf.lineCol(o.pos)
+	}
+	return l
+}
+
+// lineCol is like pos.loc but returns numbers and caches line positions.
+func (conf *Config) lineCol(p pos) (line int, column int) {
+	if conf.lineStarts == nil {
+		conf.lineStarts = []int{0}
+		for i := 0; i < len(conf.text); i++ {
+			if conf.text[i] == '\n' {
+				conf.lineStarts = append(conf.lineStarts, i+1)
+			}
+		}
+	}
+	lo, hi := 0, len(conf.lineStarts)
+	for lo+1 < hi {
+		mid := (lo + hi) / 2
+		if conf.lineStarts[mid] <= int(p) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo + 1, int(p) - conf.lineStarts[lo] + 1
+}
+
+// emit writes s and records the origin of each line started by it. A line's
+// origin is that of its first non-space character.
+func (conf *Config) emit(s string, o lineOrigin) {
+	if s == "" {
+		return
+	}
+	conf.write(s)
+	for {
+		if !conf.lineStarted {
+			conf.srcLines = append(conf.srcLines, o.sourceLine())
+			conf.lineStarted = true
+			conf.lineBlank = true
+		}
+		i := strings.IndexByte(s, '\n')
+		seg := s
+		if i != -1 {
+			seg = s[:i]
+		}
+		if conf.lineBlank {
+			j := strings.IndexFunc(seg, func(r rune) bool {
+				return !strings.ContainsRune(" \t\r", r)
+			})
+			if j != -1 {
+				conf.srcLines[len(conf.srcLines)-1] = o.advance(j).sourceLine()
+				conf.lineBlank = false
+			}
+		}
+		if i == -1 {
+			return
+		}
+		o = o.advance(i + 1)
+		s = s[i+1:]
+		conf.lineStarted = false
+		if s == "" {
+			return
+		}
+	}
+}
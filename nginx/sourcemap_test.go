@@ -0,0 +1,88 @@
+package nginx
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hgl/acmehugger/acme"
+)
+
+func TestSourceMap(t *testing.T) {
+	acme.AccountsDir = t.TempDir()
+	acme.ChallengeDir = "/challenge"
+	src, err := filepath.Abs("testdata/process/comment.in.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Parse(src, filepath.Dir(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.PrepareACME()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	name, err := tr.Dump(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line int
+		want SourceLine
+	}{
+		{1, SourceLine{File: src, Line: 1, Column: 1}},
+		{5, SourceLine{File: src, Line: 6, Column: 9}},
+		{6, SourceLine{File: src, Line: 9, Column: 9}},
+		{8, SourceLine{File: src, Line: 5, Column: 5, Synthesized: true}},
+		{11, SourceLine{File: src, Line: 12, Column: 5}},
+	}
+	for _, test := range tests {
+		got, ok := tr.SourceMap().Lookup(name, test.line)
+		if !ok {
+			t.Errorf("line %d not found", test.line)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("line %d = %+v, want %+v", test.line, got, test.want)
+		}
+	}
+	if _, ok := tr.SourceMap().Lookup(name, 100); ok {
+		t.Errorf("out of range line should not be found")
+	}
+
+	var b strings.Builder
+	w := tr.SourceMap().Writer(&b)
+	msg := `nginx: [emerg] unknown directive "x" in ` + name + ":6\n"
+	_, err = w.Write([]byte(msg[:20]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte(msg[20:] + "nginx: [emerg] bad in " + name + ":8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `nginx: [emerg] unknown directive "x" in ` + src + ":9\n" +
+		"nginx: [emerg] bad in " + name + ":8 (synthesized by acmehugger in the block at " + src + ":5)\n"
+	if got := b.String(); got != want {
+		t.Errorf("rewritten\n%s\nwant\n%s", got, want)
+	}
+	b.Reset()
+	_, err = w.Write([]byte(msg[:len(msg)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("partial line should not be written before closing, got %q", b.String())
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `nginx: [emerg] unknown directive "x" in ` + src + ":9"
+	if got := b.String(); got != want {
+		t.Errorf("rewritten after closing\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,39 @@
+package nginx
+
+import (
+	"slices"
+	"time"
+)
+
+// RestartDelay is how long to wait before restarting nginx after it exits
+// unexpectedly. It doubles with each recent exit, up to RestartMaxDelay.
+var RestartDelay = time.Second
+var RestartMaxDelay = time.Minute
+
+// CrashLoopLimit is how many times nginx can exit unexpectedly within
+// CrashLoopWindow before nginxh gives up restarting it.
+var CrashLoopLimit = 5
+var CrashLoopWindow = 10 * time.Minute
+
+// restartPolicy decides when to restart nginx after it exits unexpectedly.
+type restartPolicy struct {
+	// exits are the recent times nginx exited
+	exits []time.Time
+}
+
+// exited records nginx exiting at now, and returns how long to wait before
+// restarting it, or false if it exits too often to be restarted.
+func (p *restartPolicy) exited(now time.Time) (time.Duration, bool) {
+	p.exits = slices.DeleteFunc(p.exits, func(t time.Time) bool {
+		return now.Sub(t) >= CrashLoopWindow
+	})
+	p.exits = append(p.exits, now)
+	if len(p.exits) > CrashLoopLimit {
+		return 0, false
+	}
+	delay := RestartDelay
+	for i := 1; i < len(p.exits) && delay < RestartMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, RestartMaxDelay), true
+}
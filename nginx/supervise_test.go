@@ -0,0 +1,66 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+func TestRestartPolicy(t *testing.T) {
+	var p restartPolicy
+	now := time.Time{}
+	want := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		16 * time.Second,
+	}
+	for i, w := range want {
+		delay, ok := p.exited(now)
+		if !ok || delay != w {
+			t.Errorf("exit %d: delay = %v, %v, want %v, true", i+1, delay, ok, w)
+		}
+		now = now.Add(time.Minute)
+	}
+	_, ok := p.exited(now)
+	if ok {
+		t.Errorf("nginx exiting too often should not be restarted")
+	}
+	now = now.Add(CrashLoopWindow)
+	delay, ok := p.exited(now)
+	if !ok || delay != time.Second {
+		t.Errorf("delay after a quiet window = %v, %v, want %v, true", delay, ok, time.Second)
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	origDelay, origLimit := RestartDelay, CrashLoopLimit
+	defer func() {
+		RestartDelay, CrashLoopLimit = origDelay, origLimit
+	}()
+	RestartDelay = time.Millisecond
+	CrashLoopLimit = 2
+
+	// exits right after starting
+	bin, conf := writeNginx(t, `echo started >> "$0.log"
+exit 1
+`, "daemon off;\nevents {}\n")
+
+	r := newRunner(conf, bin, nil, nil)
+	r.supervise = true
+	err := r.run()
+	if code := ExitCode(err); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	log, err := util.ReadText(bin + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// started once, and restarted until exiting more than the limit
+	if n := strings.Count(log, "started"); n != 3 {
+		t.Errorf("nginx started %d times, want 3", n)
+	}
+}
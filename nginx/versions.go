@@ -0,0 +1,207 @@
+package nginx
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+// ConfKeepVersions is the number of config versions kept in ConfOutDir, for
+// rolling back.
+var ConfKeepVersions = 5
+
+// ConfVersions manages the configs dumped into dir. Each dump goes into a new
+// version directory under dir/versions, and only becomes visible through the
+// dir/current symlink once it's completely written, so nginx never reads a
+// partially dumped config.
+type ConfVersions struct {
+	dir  string
+	keep int
+}
+
+func NewConfVersions(dir string, keep int) *ConfVersions {
+	return &ConfVersions{dir: dir, keep: keep}
+}
+
+func (v *ConfVersions) versionsDir() string {
+	return filepath.Join(v.dir, "versions")
+}
+
+func (v *ConfVersions) versionDir(n int) string {
+	return filepath.Join(v.versionsDir(), strconv.Itoa(n))
+}
+
+// CurrentDir returns the symlink to the current version.
+func (v *ConfVersions) CurrentDir() string {
+	return filepath.Join(v.dir, "current")
+}
+
+// Versions returns the existing versions, oldest first.
+func (v *ConfVersions) Versions() ([]int, error) {
+	entries, err := os.ReadDir(v.versionsDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, entry := range entries {
+		n, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		versions = append(versions, n)
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// Current returns the current version, or 0 if there is none.
+func (v *ConfVersions) Current() (int, error) {
+	target, err := os.Readlink(v.CurrentDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(filepath.Base(target))
+	if err != nil {
+		return 0, fmt.Errorf("invalid current config version: %s", target)
+	}
+	return n, nil
+}
+
+// Dump dumps the tree into a new version and makes it current. It returns
+// the path of the entry config through the current symlink, which always
+// refers to the current version.
+func (v *ConfVersions) Dump(tr *Tree) (string, error) {
+	n, _, err := v.Prepare(tr)
+	if err != nil {
+		return "", err
+	}
+	err = v.Activate(tr, n)
+	if err != nil {
+		return "", err
+	}
+	return v.CurrentConf(tr), nil
+}
+
+// CurrentConf returns the path of the tree's entry config through the
+// current symlink.
+func (v *ConfVersions) CurrentConf(tr *Tree) string {
+	return filepath.Join(v.CurrentDir(), tr.conf.path)
+}
+
+// Prepare dumps the tree into a new version without making it current. It
+// returns the version and the path of the entry config in it.
+func (v *ConfVersions) Prepare(tr *Tree) (n int, name string, err error) {
+	versions, err := v.Versions()
+	if err != nil {
+		return 0, "", err
+	}
+	n = 1
+	if len(versions) != 0 {
+		n = versions[len(versions)-1] + 1
+	}
+	dir := v.versionDir(n)
+	name, err = tr.Dump(dir)
+	if err == nil {
+		err = util.SyncTree(dir)
+	}
+	if err != nil {
+		v.Discard(tr, n)
+		return 0, "", err
+	}
+	slog.Debug("config version dumped", "version", n, "dir", dir)
+	return n, name, nil
+}
+
+// Discard removes a version that is not current.
+func (v *ConfVersions) Discard(tr *Tree, n int) {
+	dir := v.versionDir(n)
+	err := os.RemoveAll(dir)
+	if err != nil {
+		slog.Error("failed to remove config version", "version", n, "error", err)
+	}
+	tr.srcMap.forget(dir)
+}
+
+// Activate makes the version current, and removes old versions.
+func (v *ConfVersions) Activate(tr *Tree, n int) error {
+	err := v.activate(tr, n)
+	if err != nil {
+		return err
+	}
+	err = v.collect(tr)
+	if err != nil {
+		slog.Error("failed to remove old config versions", "error", err)
+	}
+	return nil
+}
+
+// Rollback makes the version before the current one current again.
+func (v *ConfVersions) Rollback(tr *Tree) error {
+	cur, err := v.Current()
+	if err != nil {
+		return err
+	}
+	versions, err := v.Versions()
+	if err != nil {
+		return err
+	}
+	i := slices.Index(versions, cur)
+	if i <= 0 {
+		return errors.New("no config version to roll back to")
+	}
+	err = v.activate(tr, versions[i-1])
+	if err != nil {
+		return err
+	}
+	slog.Debug("config version rolled back", "from", cur, "to", versions[i-1])
+	return nil
+}
+
+func (v *ConfVersions) activate(tr *Tree, n int) error {
+	dir := v.versionDir(n)
+	err := util.SymlinkAtomic(filepath.Join("versions", strconv.Itoa(n)), v.CurrentDir())
+	if err != nil {
+		return err
+	}
+	tr.srcMap.link(v.CurrentDir(), dir)
+	return nil
+}
+
+// collect removes the versions older than the newest ones to keep, except
+// for the current one.
+func (v *ConfVersions) collect(tr *Tree) error {
+	versions, err := v.Versions()
+	if err != nil {
+		return err
+	}
+	cur, err := v.Current()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, n := range versions {
+		if i >= len(versions)-v.keep || n == cur {
+			continue
+		}
+		dir := v.versionDir(n)
+		err := os.RemoveAll(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tr.srcMap.forget(dir)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,95 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hgl/acmehugger/internal/util"
+)
+
+func TestConfVersions(t *testing.T) {
+	tr := parseText(t, `events {}
+http {
+	server {
+		listen 80;
+	}
+}
+`)
+	dir := t.TempDir()
+	v := NewConfVersions(dir, 2)
+	var name string
+	for i := 0; i < 3; i++ {
+		var err error
+		name, err = v.Dump(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := filepath.Join(dir, "current", tr.Config().Path()); name != want {
+		t.Errorf("dumped to %s, want %s", name, want)
+	}
+	versions, err := v.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{2, 3}; !slices.Equal(versions, want) {
+		t.Errorf("versions = %v, want %v", versions, want)
+	}
+	cur, err := v.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur != 3 {
+		t.Errorf("current version = %d, want 3", cur)
+	}
+	exist, err := util.FileExist(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist {
+		t.Errorf("config should exist through the current symlink")
+	}
+	src, ok := tr.SourceMap().Lookup(name, 4)
+	if !ok || src.File != tr.Config().Path() || src.Line != 4 {
+		t.Errorf("line looked up through the current symlink = %+v, want line 4", src)
+	}
+	old := filepath.Join(dir, "versions", "1", tr.Config().Path())
+	if _, ok := tr.SourceMap().Lookup(old, 1); ok {
+		t.Errorf("collected versions should be removed from the source map")
+	}
+
+	err = v.Rollback(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err = v.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur != 2 {
+		t.Errorf("current version after rollback = %d, want 2", cur)
+	}
+	err = v.Rollback(tr)
+	if err == nil {
+		t.Errorf("rollback should fail without an older version")
+	}
+
+	// a new version is numbered after the newest one, not the current one
+	_, err = v.Dump(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err = v.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 4}; !slices.Equal(versions, want) {
+		t.Errorf("versions = %v, want %v", versions, want)
+	}
+	_, err = os.Stat(filepath.Join(dir, "current.tmp"))
+	if !os.IsNotExist(err) {
+		t.Errorf("temporary symlink should not be left")
+	}
+}
@@ -105,6 +105,10 @@ func (d *SimpleDirective) Accept(visitor Visitor) error {
 	return nil
 }
 
+func (d *RawBlockDirective) Accept(visitor Visitor) error {
+	return nil
+}
+
 func (d *IncludeDirective) Accept(visitor Visitor) error {
 	for _, conf := range d.Includes {
 		err := conf.Accept(visitor)
@@ -0,0 +1,138 @@
+package nginx
+
+import (
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hgl/acmehugger/internal/clock"
+	"github.com/hgl/acmehugger/internal/set"
+)
+
+// WatchDelay is how long config files must stay unchanged before a change
+// to them is reported, so that a batch of edits causes a single reload.
+var WatchDelay = time.Second
+
+// confWatcher watches the config files of a tree, including new files
+// matching its glob includes.
+type confWatcher struct {
+	w *fsnotify.Watcher
+	// C receives when config files have changed.
+	C     chan struct{}
+	names set.Set[string]
+	globs []string
+	dirs  set.Set[string]
+	mu    sync.Mutex
+}
+
+func newConfWatcher() (*confWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	cw := &confWatcher{
+		w:     w,
+		C:     make(chan struct{}, 1),
+		names: set.NewSet[string](),
+		dirs:  set.NewSet[string](),
+	}
+	go cw.run()
+	return cw, nil
+}
+
+// watch replaces the watched files with the entry config name and the files
+// of tr, which can be nil if the entry config failed to parse.
+func (cw *confWatcher) watch(name string, tr *Tree) {
+	names := set.NewSet(name)
+	var globs []string
+	if tr != nil {
+		for name := range tr.includedConfs {
+			names.Add(name)
+		}
+		globs = tr.includeGlobs
+	}
+	// watch directories instead of files, so that files replaced by renaming
+	// (like most editors do) and new files are noticed
+	dirs := set.NewSet[string]()
+	for name := range names {
+		dirs.Add(filepath.Dir(name))
+	}
+	for _, glob := range globs {
+		dirs.Add(filepath.Dir(glob))
+	}
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.names = names
+	cw.globs = globs
+	for dir := range cw.dirs {
+		if _, ok := dirs[dir]; !ok {
+			cw.w.Remove(dir)
+		}
+	}
+	for dir := range dirs {
+		if _, ok := cw.dirs[dir]; ok {
+			continue
+		}
+		err := cw.w.Add(dir)
+		if err != nil {
+			slog.Error("failed to watch config directory", "dir", dir, "error", err)
+			delete(dirs, dir)
+		}
+	}
+	cw.dirs = dirs
+}
+
+func (cw *confWatcher) matches(name string) bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if _, ok := cw.names[name]; ok {
+		return true
+	}
+	for _, glob := range cw.globs {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (cw *confWatcher) run() {
+	var timer clock.Timer
+	var timerC <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-cw.w.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod || !cw.matches(filepath.Clean(ev.Name)) {
+				continue
+			}
+			slog.Debug("config file changed", "name", ev.Name, "op", ev.Op)
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = clock.NewTimer(WatchDelay)
+			timerC = timer.C()
+		case err, ok := <-cw.w.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("failed to watch config files", "error", err)
+		case <-timerC:
+			timer = nil
+			timerC = nil
+			select {
+			case cw.C <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (cw *confWatcher) Close() error {
+	return cw.w.Close()
+}
@@ -0,0 +1,74 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfWatcher(t *testing.T) {
+	origDelay := WatchDelay
+	defer func() {
+		WatchDelay = origDelay
+	}()
+	WatchDelay = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	write := func(name string, text string) {
+		t.Helper()
+		err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("nginx.conf", `events {}
+include other.conf;
+http {
+	include conf.d/*.conf;
+}
+`)
+	write("other.conf", "")
+	write("conf.d/a.conf", "")
+	name := filepath.Join(dir, "nginx.conf")
+	tr, err := Parse(name, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, err := newConfWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Close()
+	cw.watch(name, tr)
+
+	changed := func(desc string, want bool) {
+		t.Helper()
+		select {
+		case <-cw.C:
+			if !want {
+				t.Errorf("%s should not be reported", desc)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if want {
+				t.Errorf("%s should be reported", desc)
+			}
+		}
+	}
+	write("other.conf", "# changed")
+	changed("changing an included file", true)
+	write("conf.d/b.conf", "")
+	changed("adding a file matching a glob include", true)
+	write("conf.d/b.txt", "")
+	changed("adding a file not matching a glob include", false)
+	write("unrelated.conf", "")
+	changed("changing a file not included", false)
+	write("nginx.conf", "events {}\n")
+	write("conf.d/a.conf", "# changed")
+	changed("changing multiple files", true)
+	changed("changing multiple files again", false)
+}